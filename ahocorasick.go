@@ -0,0 +1,160 @@
+package main
+
+// acAutomaton is an Aho–Corasick automaton over a set of byte strings, which
+// finds occurrences of all of them in a single pass over the text, however
+// many there are.
+//
+// Bytes that appear in no pattern share a single input class, so the
+// transition table has one row per trie node and one column per distinct
+// byte in the patterns, plus one.
+type acAutomaton struct {
+	// class maps each byte to its column in next.
+	class   [256]int32
+	classes int
+
+	// next is the full transition table: next[node*classes+class] is the
+	// node reached from node on a byte of class. Failure transitions are
+	// folded in, so scanning never backtracks.
+	next []int32
+
+	// depth is the length of the pattern prefix each node spells.
+	depth []int
+
+	// out is the longest pattern that ends at each node, whether it is the
+	// node's own or a suffix of it, or -1 if none does.
+	out []int32
+
+	// lengths holds the length of each pattern.
+	lengths []int
+}
+
+// newACAutomaton builds the automaton for patterns. Empty patterns never
+// match. When a pattern appears more than once, only its first occurrence
+// is ever reported.
+func newACAutomaton(patterns []string) *acAutomaton {
+	a := &acAutomaton{lengths: make([]int, len(patterns))}
+	a.classes = 1
+	for _, p := range patterns {
+		for i := 0; i < len(p); i++ {
+			if a.class[p[i]] == 0 {
+				a.class[p[i]] = int32(a.classes)
+				a.classes++
+			}
+		}
+	}
+
+	// Build the trie, with -1 marking missing transitions.
+	a.addNode(0)
+	for i, p := range patterns {
+		a.lengths[i] = len(p)
+		if p == "" {
+			continue
+		}
+		node := int32(0)
+		for j := 0; j < len(p); j++ {
+			c := int(a.class[p[j]])
+			if a.next[int(node)*a.classes+c] < 0 {
+				a.next[int(node)*a.classes+c] = a.addNode(j + 1)
+			}
+			node = a.next[int(node)*a.classes+c]
+		}
+		if a.out[node] < 0 {
+			a.out[node] = int32(i)
+		}
+	}
+
+	// Work out failure links breadth first, so that each node's failure
+	// node is finished before the node itself, and fold them into the
+	// transition table.
+	fail := make([]int32, len(a.depth))
+	queue := []int32{}
+	for c := 0; c < a.classes; c++ {
+		if child := a.next[c]; child < 0 {
+			a.next[c] = 0
+		} else {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if a.out[node] < 0 {
+			a.out[node] = a.out[fail[node]]
+		}
+		row := int(node) * a.classes
+		failRow := int(fail[node]) * a.classes
+		for c := 0; c < a.classes; c++ {
+			if child := a.next[row+c]; child < 0 {
+				a.next[row+c] = a.next[failRow+c]
+			} else {
+				fail[child] = a.next[failRow+c]
+				queue = append(queue, child)
+			}
+		}
+	}
+	return a
+}
+
+// addNode appends a trie node spelling a prefix of length depth, with no
+// transitions, and returns it.
+func (a *acAutomaton) addNode(depth int) int32 {
+	node := int32(len(a.depth))
+	a.depth = append(a.depth, depth)
+	a.out = append(a.out, -1)
+	for c := 0; c < a.classes; c++ {
+		a.next = append(a.next, -1)
+	}
+	return node
+}
+
+// acMatch is an occurrence of pattern in the text, at [start, end).
+type acMatch struct {
+	pattern int
+	start   int
+	end     int
+}
+
+// findAll returns the leftmost-longest occurrences of the patterns in s: the
+// occurrence that starts first wins, the longest of those that start at the
+// same place wins among them, and scanning resumes after it, so occurrences
+// never overlap.
+func (a *acAutomaton) findAll(s string) []acMatch {
+	var matches []acMatch
+	for i := 0; ; {
+		found, ok := a.findFrom(s, i)
+		if !ok {
+			return matches
+		}
+		matches = append(matches, found)
+		i = found.end
+	}
+}
+
+// findFrom returns the leftmost-longest occurrence of the patterns in s that
+// starts at or after from, scanning no further than it takes to settle it.
+func (a *acAutomaton) findFrom(s string, from int) (acMatch, bool) {
+	best := acMatch{pattern: -1}
+	next, class, classes := a.next, &a.class, int32(a.classes)
+	node := int32(0)
+	for i := from; i < len(s); {
+		node = next[node*classes+class[s[i]]]
+		i++
+
+		// The longest pattern ending here is the one that starts
+		// leftmost. Being found later, it is also longer than the best
+		// so far if they start at the same place.
+		if p := a.out[node]; p >= 0 {
+			if start := i - a.lengths[p]; best.pattern < 0 || start <= best.start {
+				best = acMatch{pattern: int(p), start: start, end: i}
+			}
+		}
+
+		// Once no partial match reaches back to the best match's start,
+		// nothing found later can beat it.
+		if best.pattern >= 0 && i-a.depth[node] > best.start {
+			return best, true
+		}
+	}
+	// The text has run out, so nothing can beat the best match either.
+	return best, best.pattern >= 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// naiveFindAll is the leftmost-longest search acAutomaton implements, done
+// the way multiLiteralMatcher used to: by keeping track of the next
+// occurrence of every pattern with strings.Index.
+func naiveFindAll(patterns []string, s string) []acMatch {
+	next := make([]int, len(patterns))
+	for p := range next {
+		next[p] = -2
+	}
+
+	var matches []acMatch
+	for i := 0; i <= len(s); {
+		best := -1
+		for p, pattern := range patterns {
+			if pattern == "" {
+				continue
+			}
+			if next[p] != -1 && next[p] < i {
+				next[p] = strings.Index(s[i:], pattern)
+				if next[p] >= 0 {
+					next[p] += i
+				}
+			}
+			if next[p] < 0 {
+				continue
+			}
+			if best < 0 || next[p] < next[best] || (next[p] == next[best] && len(pattern) > len(patterns[best])) {
+				best = p
+			}
+		}
+		if best < 0 {
+			break
+		}
+		matches = append(matches, acMatch{pattern: best, start: next[best], end: next[best] + len(patterns[best])})
+		i = next[best] + len(patterns[best])
+	}
+	return matches
+}
+
+func TestACAutomatonFindAll(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		s        string
+		want     []acMatch
+	}{
+		{[]string{"he", "she", "his", "hers"}, "ushers", []acMatch{{1, 1, 4}}},
+		{[]string{"ab", "abc", "bcd"}, "abcd", []acMatch{{1, 0, 3}}},
+		// A long partial match that fails must not hide a shorter
+		// match that started before it finished.
+		{[]string{"abcdef", "bc"}, "abcdxf", []acMatch{{1, 1, 3}}},
+		{[]string{"abcdef", "cd", "b"}, "abcdeX", []acMatch{{2, 1, 2}, {1, 2, 4}}},
+		// Duplicate patterns report the first.
+		{[]string{"x", "ab", "ab"}, "abab", []acMatch{{1, 0, 2}, {1, 2, 4}}},
+		{[]string{"", "a"}, "aa", []acMatch{{1, 0, 1}, {1, 1, 2}}},
+		{[]string{"aa"}, "aaa", []acMatch{{0, 0, 2}}},
+		{[]string{"ü", "über"}, "übermensch über", []acMatch{{1, 0, 5}, {1, 12, 17}}},
+		{[]string{"a"}, "", nil},
+		{nil, "abc", nil},
+	}
+	for _, tc := range tests {
+		got := newACAutomaton(tc.patterns).findAll(tc.s)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("findAll(%q) with %q = %v; want %v", tc.s, tc.patterns, got, tc.want)
+		}
+	}
+}
+
+func TestACAutomatonMatchesNaiveSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomString := func(alphabet string, max int) string {
+		b := make([]byte, rng.Intn(max+1))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+	for n := 0; n < 2000; n++ {
+		patterns := make([]string, 1+rng.Intn(8))
+		for i := range patterns {
+			patterns[i] = randomString("abc", 5)
+		}
+		s := randomString("abcd", 40)
+		got := newACAutomaton(patterns).findAll(s)
+		if want := naiveFindAll(patterns, s); !reflect.DeepEqual(got, want) {
+			t.Fatalf("findAll(%q) with %q = %v; want %v", s, patterns, got, want)
+		}
+	}
+}
+
+// benchmarkSymbols returns a table of count find/replace pairs renaming API
+// symbols, and a text of about size bytes that uses some of them.
+func benchmarkSymbols(count int, size int) ([]literalPair, string) {
+	rng := rand.New(rand.NewSource(1))
+	pairs := make([]literalPair, count)
+	for i := range pairs {
+		pairs[i] = literalPair{find: fmt.Sprintf("oldSymbol%dName", i), replace: fmt.Sprintf("newSymbol%dName", i)}
+	}
+	var b strings.Builder
+	for b.Len() < size {
+		if rng.Intn(4) == 0 {
+			b.WriteString(pairs[rng.Intn(count)].find)
+		} else {
+			b.WriteString("func example(value int) error { return nil }")
+		}
+		b.WriteByte('\n')
+	}
+	return pairs, b.String()
+}
+
+func BenchmarkLiteralPairs(b *testing.B) {
+	for _, count := range []int{1, 10, 100, 1000} {
+		pairs, s := benchmarkSymbols(count, 256*1024)
+		b.Run(fmt.Sprintf("pairs=%d/ReplaceAll", count), func(b *testing.B) {
+			b.SetBytes(int64(len(s)))
+			for n := 0; n < b.N; n++ {
+				out := s
+				for _, pair := range pairs {
+					out = strings.ReplaceAll(out, pair.find, pair.replace)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("pairs=%d/Index", count), func(b *testing.B) {
+			patterns := make([]string, len(pairs))
+			for i, pair := range pairs {
+				patterns[i] = pair.find
+			}
+			b.SetBytes(int64(len(s)))
+			for n := 0; n < b.N; n++ {
+				naiveFindAll(patterns, s)
+			}
+		})
+		b.Run(fmt.Sprintf("pairs=%d/AhoCorasick", count), func(b *testing.B) {
+			m := newMultiLiteralMatcher(pairs)
+			b.SetBytes(int64(len(s)))
+			for n := 0; n < b.N; n++ {
+				replaceMatches(s, m.findAll(s))
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stagedWrite is a rewrite held back by --atomic: the new contents of path
+// are waiting in temp, before and after are the checksums the journal needs,
+// and stats describe the rewrite to the reporter.
+type stagedWrite struct {
+	path   string
+	temp   string
+	before string
+	after  string
+	stats  rewriteStats
+
+	// inPlace copies the new contents into the existing file, for
+	// --hardlinks=inplace, rather than moving temp over it.
+	inPlace bool
+
+	// link, if set, makes this the relinking of the symlink at path rather
+	// than a rewrite: temp is a symlink to link, and before is the old
+	// target.
+	link string
+
+	// backup holds the original file once the write has been committed,
+	// until the whole transaction succeeds.
+	backup string
+}
+
+// plannedRename is a rename held back by --atomic.
+type plannedRename struct {
+	oldPath string
+	newPath string
+}
+
+// transaction collects the rewrites and renames of an --atomic run while the
+// tree is walked, so that they can be applied only once every one of them
+// has been worked out without error. Renames are kept in the order the walk
+// made them, so that a directory is renamed after everything inside it, as
+// in a normal run. It is safe for concurrent use.
+type transaction struct {
+	mu      sync.Mutex
+	writes  []stagedWrite
+	renames []plannedRename
+
+	// targets holds the new path of every planned rename, and moves maps
+	// each renamed path to its new path.
+	targets map[string]bool
+	moves   map[string]string
+
+	// fsync syncs every change to disk once they have all been applied.
+	fsync bool
+}
+
+// stageWrite records that the new contents of path are staged in temp, to be
+// copied into it if inPlace is set.
+func (tx *transaction) stageWrite(path string, temp string, before string, after string, stats rewriteStats, inPlace bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.writes = append(tx.writes, stagedWrite{path: path, temp: temp, before: before, after: after, stats: stats, inPlace: inPlace})
+}
+
+// stageRelink records that a symlink to newTarget is staged in temp, to
+// replace the symlink at path, which points to target.
+func (tx *transaction) stageRelink(path string, temp string, target string, newTarget string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.writes = append(tx.writes, stagedWrite{path: path, temp: temp, before: target, link: newTarget})
+}
+
+// planRename records that oldPath is to be renamed to newPath. It returns an
+// error if another planned rename already claims newPath.
+func (tx *transaction) planRename(oldPath string, newPath string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.targets[newPath] {
+		return fmt.Errorf("refusing to rename %v to %v: %v is already the target of another rename", oldPath, filepath.Base(newPath), newPath)
+	}
+	if tx.targets == nil {
+		tx.targets = make(map[string]bool)
+		tx.moves = make(map[string]string)
+	}
+	tx.targets[newPath] = true
+	tx.moves[oldPath] = newPath
+	tx.renames = append(tx.renames, plannedRename{oldPath: oldPath, newPath: newPath})
+	return nil
+}
+
+// discard deletes every staged rewrite, leaving the tree untouched.
+func (tx *transaction) discard() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for _, w := range tx.writes {
+		os.Remove(w.temp)
+	}
+	tx.writes, tx.renames = nil, nil
+}
+
+// commit applies every staged rewrite and then every planned rename. If any
+// of them fails, everything already applied is rolled back and the remaining
+// staged rewrites are deleted, so the tree is left as it was. Each change is
+// reported to rep as it is applied, and recorded in j, if set, once the whole
+// transaction has succeeded.
+func (tx *transaction) commit(j *journal, rep reporter) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	// Swap each rewrite into place, keeping the original alongside it
+	// until the end so that it can be put back.
+	var err error
+	wrote := 0
+	for ; wrote < len(tx.writes); wrote++ {
+		w := &tx.writes[wrote]
+		w.backup = filepath.Join(filepath.Dir(w.path), RandomString(20))
+		if w.inPlace {
+			// Every hard link must see the new contents, so the
+			// original is copied aside rather than moved.
+			if err = copyContents(w.path, w.backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL); err != nil {
+				os.Remove(w.backup)
+				w.backup = ""
+				break
+			}
+			if err = copyContents(w.temp, w.path, os.O_WRONLY|os.O_TRUNC); err != nil {
+				wrote++
+				break
+			}
+			os.Remove(w.temp)
+			rep.rewrote(w.path, w.stats, false)
+			continue
+		}
+		if err = os.Rename(w.path, w.backup); err != nil {
+			err = fmt.Errorf("back up %v: %w", w.path, err)
+			w.backup = ""
+			break
+		}
+		if err = os.Rename(w.temp, w.path); err != nil {
+			err = fmt.Errorf("atomically move temp file %v to %v: %w", w.temp, w.path, err)
+			wrote++
+			break
+		}
+		if w.link != "" {
+			rep.relinked(w.path, w.before, w.link, false)
+		} else {
+			rep.rewrote(w.path, w.stats, false)
+		}
+	}
+
+	renamed := 0
+	if err == nil {
+		for ; renamed < len(tx.renames); renamed++ {
+			r := tx.renames[renamed]
+			if _, statErr := os.Lstat(r.newPath); statErr == nil {
+				err = fmt.Errorf("refusing to rename %v to %v: %v already exists", r.oldPath, filepath.Base(r.newPath), r.newPath)
+				break
+			}
+			if err = os.Rename(r.oldPath, r.newPath); err != nil {
+				err = fmt.Errorf("rename %v to %v: %w", r.oldPath, filepath.Base(r.newPath), err)
+				break
+			}
+			rep.renamed(r.oldPath, r.newPath, false)
+		}
+	}
+
+	if err != nil {
+		rep.failed(err)
+		return errors.Join(err, tx.rollback(wrote, renamed, rep))
+	}
+
+	var errs []error
+	for _, w := range tx.writes {
+		// The backup has moved with any directory above it.
+		errs = append(errs, os.Remove(tx.finalPath(w.backup)))
+		if j != nil && w.link != "" {
+			errs = append(errs, j.relinked(w.path, w.before, w.link))
+		} else if j != nil {
+			errs = append(errs, j.rewrote(w.path, w.before, w.after))
+		}
+	}
+	if j != nil {
+		for _, r := range tx.renames {
+			errs = append(errs, j.renamed(r.oldPath, r.newPath))
+		}
+	}
+	if tx.fsync {
+		errs = append(errs, tx.sync())
+	}
+	return errors.Join(errs...)
+}
+
+// sync flushes every change of a committed transaction to disk: the contents
+// of each file rewritten in place, and each directory something was moved
+// into. Staged rewrites were synced as they were staged.
+func (tx *transaction) sync() error {
+	dirs := make(map[string]bool)
+	var errs []error
+	for _, w := range tx.writes {
+		if w.inPlace {
+			errs = append(errs, fsyncFile(tx.finalPath(w.path)))
+		} else {
+			dirs[tx.finalPath(filepath.Dir(w.path))] = true
+		}
+	}
+	for _, r := range tx.renames {
+		dirs[tx.finalPath(filepath.Dir(r.newPath))] = true
+	}
+	for dir := range dirs {
+		errs = append(errs, fsyncDir(dir))
+	}
+	return errors.Join(errs...)
+}
+
+// finalPath returns where path ends up once every planned rename has been
+// applied.
+func (tx *transaction) finalPath(path string) string {
+	dir := filepath.Dir(path)
+	if dir != path {
+		dir = tx.finalPath(dir)
+	}
+	if newPath, ok := tx.moves[path]; ok {
+		return filepath.Join(dir, filepath.Base(newPath))
+	}
+	return filepath.Join(dir, filepath.Base(path))
+}
+
+// rollback reverses the first renamed renames and the first wrote rewrites
+// of a failed commit, latest first, and deletes every staged rewrite.
+// Rollback failures are reported to rep.
+func (tx *transaction) rollback(wrote int, renamed int, rep reporter) error {
+	rep.noted("Rolling back")
+	var errs []error
+	for i := renamed - 1; i >= 0; i-- {
+		r := tx.renames[i]
+		if err := os.Rename(r.newPath, r.oldPath); err != nil {
+			errs = append(errs, fmt.Errorf("roll back rename of %v: %w", r.oldPath, err))
+		}
+	}
+	for i := wrote - 1; i >= 0; i-- {
+		w := tx.writes[i]
+		if w.backup == "" {
+			continue
+		}
+		var err error
+		if w.inPlace {
+			if err = copyContents(w.backup, w.path, os.O_WRONLY|os.O_TRUNC); err == nil {
+				os.Remove(w.backup)
+			}
+		} else {
+			err = os.Rename(w.backup, w.path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("roll back rewrite of %v (original kept at %v): %w", w.path, w.backup, err))
+		}
+	}
+	for _, w := range tx.writes {
+		os.Remove(w.temp)
+	}
+	for _, err := range errs {
+		rep.failed(err)
+	}
+	return errors.Join(errs...)
+}
+
+// finishAtomic commits the changes staged by an --atomic walk if the walk
+// succeeded, and discards them otherwise.
+func (fr *findReplace) finishAtomic() {
+	if fr.errs.err() != nil {
+		fr.reporter().noted("Not changing anything because of the errors above")
+		fr.atomic.discard()
+		return
+	}
+	fr.errs.add(fr.atomic.commit(fr.journal, fr.reporter()))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// listTree returns the slash-separated path of every entry under root.
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WalkDir(%q): %v", root, err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// assertListing fails the test unless the entries under root are exactly
+// want.
+func assertListing(t *testing.T, root string, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if got := listTree(t, root); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tree under %v = %q; want %q", root, got, want)
+	}
+}
+
+func TestRun_AtomicCommits(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha/alpha.txt": "alpha", "keep.txt": "alpha"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--atomic", "alpha", "beta")
+	assertListing(t, dir, "beta", "beta/beta.txt", "keep.txt")
+	assertTree(t, dir, map[string]string{"beta/beta.txt": "beta", "keep.txt": "beta"})
+}
+
+func TestRun_AtomicChangesNothingOnError(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a/alpha.txt": "alpha",
+		"a/beta.txt":  "occupied",
+		"b/alpha.md":  "alpha",
+	})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--atomic", "alpha", "beta"}, nil, io.Discard, &stderr); got != 1 {
+		t.Fatalf("run = %d; want 1", got)
+	}
+	assertListing(t, dir, "a", "a/alpha.txt", "a/beta.txt", "b", "b/alpha.md")
+	assertTree(t, dir, map[string]string{"a/alpha.txt": "alpha", "b/alpha.md": "alpha"})
+}
+
+// TestTransactionRollsBackFailedCommit makes the last rename of a commit
+// fail, and confirms that everything applied before it is undone.
+func TestTransactionRollsBackFailedCommit(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha/alpha.txt": "alpha", "other.txt": "alpha"})
+	captureLog(t)
+
+	fr := findReplace{find: "alpha", replace: "beta", atomic: &transaction{}}
+	fr.WalkDir(newFileOrFatal(t, dir))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+
+	// Occupy the directory's new name after it was planned.
+	if err := os.Mkdir(filepath.Join(dir, "beta"), 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := fr.atomic.commit(nil, textReporter{}); err == nil {
+		t.Fatalf("commit succeeded; want an error")
+	}
+	assertListing(t, dir, "alpha", "alpha/alpha.txt", "beta", "other.txt")
+	assertTree(t, dir, map[string]string{"alpha/alpha.txt": "alpha", "other.txt": "alpha"})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// exitFound is the exit code of a --check run that found a match, as opposed
+// to 1 for usage and traversal errors.
+const exitFound = 2
+
+// pathColor is the SGR escape sequence file names are marked with when
+// matches are printed to a terminal, as grep does.
+const pathColor = "\x1b[35m"
+
+// checker reports the matches found by --check and --list, which change
+// nothing on disk. It is safe for concurrent use; the lines reported for each
+// file are printed together.
+type checker struct {
+	mu    sync.Mutex
+	w     io.Writer
+	found bool
+
+	// list prints each match, with its column, rather than each line with
+	// a match in it.
+	list bool
+
+	// color marks file names with pathColor.
+	color bool
+}
+
+// report prints lines, each describing a match, and records that something
+// was found if there are any.
+func (c *checker) report(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.found = true
+	for _, line := range lines {
+		fmt.Fprintln(c.w, line)
+	}
+}
+
+// foundAny reports whether any match has been reported.
+func (c *checker) foundAny() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.found
+}
+
+// contentLines returns the lines to report for matches in content, the
+// contents of path.
+func (c *checker) contentLines(path string, content string, matches []match) []string {
+	if c.list {
+		return listLines(c.colorPath(path), content, matches)
+	}
+	return checkLines(c.colorPath(path), content, matches)
+}
+
+// nameLine returns the line to report for a match in the name of path.
+func (c *checker) nameLine(path string) string {
+	if c.list {
+		return fmt.Sprintf("%v (name)", c.colorPath(path))
+	}
+	return fmt.Sprintf("%v: name matches", c.colorPath(path))
+}
+
+// targetLine returns the line to report for a match in the target of the
+// symlink at path.
+func (c *checker) targetLine(path string) string {
+	if c.list {
+		return fmt.Sprintf("%v (symlink target)", c.colorPath(path))
+	}
+	return fmt.Sprintf("%v: symlink target matches", c.colorPath(path))
+}
+
+// colorPath returns path, marked with pathColor if color is set.
+func (c *checker) colorPath(path string) string {
+	if !c.color {
+		return path
+	}
+	return pathColor + path + "\x1b[0m"
+}
+
+// isTerminal reports whether w is a terminal, and so whether output to it
+// may be colored. Setting NO_COLOR turns color off regardless.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// checkLines returns a "path:LINE: text" line for each line of content, the
+// contents of path, that holds one of matches.
+func checkLines(path string, content string, matches []match) []string {
+	var lines []string
+	line, counted, lastLine := 1, 0, 0
+	for _, m := range matches {
+		line += strings.Count(content[counted:m.start], "\n")
+		counted = m.start
+		if line == lastLine {
+			continue
+		}
+		lastLine = line
+		start := strings.LastIndex(content[:m.start], "\n") + 1
+		end := len(content)
+		if i := strings.Index(content[m.start:], "\n"); i >= 0 {
+			end = m.start + i
+		}
+		lines = append(lines, fmt.Sprintf("%v:%d: %v", path, line, strings.TrimSuffix(content[start:end], "\r")))
+	}
+	return lines
+}
+
+// listLines returns a "path:LINE:COLUMN: text" line for each of matches in
+// content, the contents of path, where text is the matched text and COLUMN
+// counts bytes from 1.
+func listLines(path string, content string, matches []match) []string {
+	var lines []string
+	line, counted := 1, 0
+	for _, m := range matches {
+		line += strings.Count(content[counted:m.start], "\n")
+		counted = m.start
+		column := m.start - (strings.LastIndex(content[:m.start], "\n") + 1) + 1
+		lines = append(lines, fmt.Sprintf("%v:%d:%d: %v", path, line, column, content[m.start:m.end]))
+	}
+	return lines
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckLines(t *testing.T) {
+	content := "alpha\nnone\r\nalpha and alpha\r\n\nend alpha"
+	m := literalMatcher{find: "alpha", replace: "beta"}
+	want := []string{
+		"f.txt:1: alpha",
+		"f.txt:3: alpha and alpha",
+		"f.txt:5: end alpha",
+	}
+	if got := checkLines("f.txt", content, m.findAll(content)); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkLines = %q; want %q", got, want)
+	}
+}
+
+// runCheck runs find-replace --check with args, and returns its exit code
+// and the lines it printed to stdout, sorted.
+func runCheck(t *testing.T, args ...string) (int, []string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"find-replace", "--check"}, args...), nil, &stdout, &stderr)
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if stdout.Len() == 0 {
+		lines = nil
+	}
+	sort.Strings(lines)
+	return code, lines
+}
+
+func TestRun_CheckReportsMatches(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	files := map[string]string{
+		"alpha/notes.txt": "first\nalpha one\nalpha two alpha\n",
+		"clean.txt":       "nothing here\n",
+		"ignored.txt":     "alpha\n",
+		".gitignore":      "ignored.txt\n",
+	}
+	writeTree(t, dir, files)
+	if err := os.WriteFile(filepath.Join(dir, "binary"), []byte("\x00alpha binary"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, lines := runCheck(t, "alpha", "beta")
+	if code != exitFound {
+		t.Errorf("run --check = %d; want %d", code, exitFound)
+	}
+	want := []string{
+		filepath.Join(dir, "alpha/notes.txt") + ":2: alpha one",
+		filepath.Join(dir, "alpha/notes.txt") + ":3: alpha two alpha",
+		filepath.Join(dir, "alpha") + ": name matches",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check printed %q; want %q", lines, want)
+	}
+
+	// Nothing changes, and there is nothing to undo.
+	assertTree(t, dir, files)
+	if _, err := os.Stat(filepath.Join(os.Getenv("XDG_STATE_HOME"), "find-replace", "runs")); !os.IsNotExist(err) {
+		t.Errorf("Stat of the journal directory = %v; want it not to exist", err)
+	}
+}
+
+func TestRun_CheckCleanTree(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"notes.txt": "nothing here\n"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	if code, lines := runCheck(t, "alpha", "beta"); code != 0 || lines != nil {
+		t.Errorf("run --check = %d, %q; want 0 and no output", code, lines)
+	}
+}
+
+func TestRun_CheckErrorsTakePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"notes.txt": "alpha\n"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	// A check that could not look everywhere has not passed, but hasn't
+	// failed on a match either.
+	if code, _ := runCheck(t, "alpha", "beta", ".", "missing"); code != 1 {
+		t.Errorf("run --check with a missing path = %d; want 1", code)
+	}
+}
+
+func TestRun_CheckDoesNotRefuseOccupiedNames(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"alpha.txt": "", "beta.txt": ""}
+	writeTree(t, dir, files)
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, lines := runCheck(t, "alpha", "beta")
+	if want := []string{filepath.Join(dir, "alpha.txt") + ": name matches"}; code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+	assertTree(t, dir, files)
+}
+
+func TestRun_CheckWithoutReplace(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"notes.txt": "x alpha\n"}
+	writeTree(t, dir, files)
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, lines := runCheck(t, "alpha")
+	if want := []string{filepath.Join(dir, "notes.txt") + ":1: x alpha"}; code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check alpha = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+	code, lines = runCheck(t, "--list", "alpha")
+	if want := []string{filepath.Join(dir, "notes.txt") + ":1:3: alpha"}; code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check --list alpha = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+	assertTree(t, dir, files)
+
+	// Without --check or --list, REPLACE is still required.
+	var stderr bytes.Buffer
+	if code := run([]string{"find-replace", "alpha"}, nil, io.Discard, &stderr); code != 1 || !strings.Contains(stderr.String(), "Usage: find-replace") {
+		t.Errorf("run alpha = %d, %q; want 1 and the usage", code, stderr.String())
+	}
+	assertTree(t, dir, files)
+}
+
+func TestRun_CheckRejectsDiff(t *testing.T) {
+	if code, _ := runCheck(t, "--diff", "alpha", "beta"); code != 1 {
+		t.Errorf("run --check --diff = %d; want 1", code)
+	}
+}
+
+func TestListLines(t *testing.T) {
+	content := "alpha\nnone\nbeta alpha alpha\nalphabet"
+	m := literalMatcher{find: "alpha", replace: "beta"}
+	want := []string{
+		"f.txt:1:1: alpha",
+		"f.txt:3:6: alpha",
+		"f.txt:3:12: alpha",
+		"f.txt:4:1: alpha",
+	}
+	if got := listLines("f.txt", content, m.findAll(content)); !reflect.DeepEqual(got, want) {
+		t.Errorf("listLines = %q; want %q", got, want)
+	}
+}
+
+func TestRun_List(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"alpha/notes.txt": "first\nsee v1 and v22\n",
+		".git/v3":         "v3",
+	}
+	writeTree(t, dir, files)
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	for _, flag := range []string{"--list", "--only-matching"} {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"find-replace", flag, "--regex", `v\d+|alpha`, "x"}, nil, &stdout, &stderr); code != 0 {
+			t.Fatalf("run %v = %d; want 0 (stderr: %q)", flag, code, stderr.String())
+		}
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		sort.Strings(lines)
+		want := []string{
+			filepath.Join(dir, "alpha") + " (name)",
+			filepath.Join(dir, "alpha/notes.txt") + ":2:12: v22",
+			filepath.Join(dir, "alpha/notes.txt") + ":2:5: v1",
+		}
+		if !reflect.DeepEqual(lines, want) {
+			t.Errorf("run %v printed %q; want %q", flag, lines, want)
+		}
+	}
+	assertTree(t, dir, files)
+}
+
+func TestRun_CheckList(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"notes.txt": "an alpha\n"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, lines := runCheck(t, "--list", "alpha", "beta")
+	if want := []string{filepath.Join(dir, "notes.txt") + ":1:4: alpha"}; code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check --list = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+}
+
+// TestRun_CheckListWithRules confirms that each rule is matched against a
+// file as it is, never against another rule's replacement.
+func TestRun_CheckListWithRules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"f": "x\nfoo\n"}
+	writeTree(t, dir, files)
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"find": "foo", "replace": "a\\nbar", "regex": true},
+		{"find": "bar", "replace": "baz", "regex": true}
+	]`
+	if err := os.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, lines := runCheck(t, "--list", "--rules", rulesPath)
+	if want := []string{filepath.Join(dir, "f") + ":2:1: foo"}; code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check --list = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+	assertTree(t, dir, files)
+}
+
+func TestCheckerColor(t *testing.T) {
+	c := checker{list: true, color: true}
+	if got, want := c.nameLine("alpha"), "\x1b[35malpha\x1b[0m (name)"; got != want {
+		t.Errorf("nameLine = %q; want %q", got, want)
+	}
+	if isTerminal(&bytes.Buffer{}) {
+		t.Errorf("isTerminal(bytes.Buffer) = true; want false")
+	}
+}
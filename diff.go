@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// diffPrinter writes a git-style patch describing every rewrite and rename,
+// which `patch -p1` can apply from the directory find-replace was run in.
+// Like git, the patch describes each file once, from its original path to the
+// path it ends up at, so directory renames appear as renames of the files
+// beneath them. Each file is written while holding a lock so that concurrent
+// walker goroutines never interleave their output.
+type diffPrinter struct {
+	w io.Writer
+
+	// context is the number of unchanged lines shown around each change.
+	context int
+
+	// base is the directory that paths in the patch are relative to.
+	base string
+
+	mu sync.Mutex
+}
+
+// printFile writes the patch for a single file: a rename from oldPath to
+// newPath if they differ, followed by a unified diff from oldContent to
+// newContent if those differ.
+func (d *diffPrinter) printFile(oldPath string, newPath string, oldContent string, newContent string) error {
+	oldName, newName := d.relPath(oldPath), d.relPath(newPath)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", oldName, newName)
+	if oldName != newName {
+		fmt.Fprintf(&b, "rename from %s\n", oldName)
+		fmt.Fprintf(&b, "rename to %s\n", newName)
+	}
+	if oldContent != newContent {
+		fmt.Fprintf(&b, "--- a/%s\n", oldName)
+		fmt.Fprintf(&b, "+++ b/%s\n", newName)
+		writeHunks(&b, diffLines(splitLines(oldContent), splitLines(newContent)), d.context)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := io.WriteString(d.w, b.String()); err != nil {
+		return fmt.Errorf("write diff of %v: %w", oldPath, err)
+	}
+	return nil
+}
+
+// relPath returns path relative to d.base using forward slashes, as patch
+// expects. Paths outside of base are left absolute.
+func (d *diffPrinter) relPath(path string) string {
+	rel, err := filepath.Rel(d.base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// splitLines splits s into lines, each keeping its trailing newline. The
+// final line lacks a newline only if s does not end with one.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLine is a single line of an edit script: kind is ' ' for a line common
+// to both sides, '-' for a deleted line, and '+' for an inserted one.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// diffLines returns a minimal edit script turning a into b.
+func diffLines(a []string, b []string) []diffLine {
+	d := differ{
+		a:       a,
+		b:       b,
+		deleted: make([]bool, len(a)),
+		added:   make([]bool, len(b)),
+	}
+	d.compare(0, len(a), 0, len(b))
+
+	script := make([]diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && d.deleted[i]:
+			script = append(script, diffLine{'-', a[i]})
+			i++
+		case j < len(b) && d.added[j]:
+			script = append(script, diffLine{'+', b[j]})
+			j++
+		default:
+			script = append(script, diffLine{' ', a[i]})
+			i++
+			j++
+		}
+	}
+	return script
+}
+
+// differ implements the linear-space variant of Myers' O(ND) diff algorithm,
+// marking which lines of a are deleted and which lines of b are added.
+type differ struct {
+	a, b    []string
+	deleted []bool
+	added   []bool
+}
+
+// compare diffs a[aLo:aHi] against b[bLo:bHi] by splitting on the middle
+// snake of an optimal edit path and recursing on either half.
+func (d *differ) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			d.added[bLo] = true
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			d.deleted[aLo] = true
+		}
+	default:
+		x, y := d.split(aLo, aHi, bLo, bHi)
+		d.compare(aLo, x, bLo, y)
+		d.compare(x, aHi, y, bHi)
+	}
+}
+
+// split returns a point on an optimal edit path through a[aLo:aHi] and
+// b[bLo:bHi], found by running the forward and backward searches until they
+// overlap. The caller guarantees both ranges are non-empty and have no common
+// prefix or suffix, so the point always divides the problem in two.
+func (d *differ) split(aLo, aHi, bLo, bHi int) (int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+
+	// forward[off+k] is the furthest x reached on diagonal k from the start;
+	// backward[off+k] is the furthest distance reached on diagonal k from the
+	// end, in reversed coordinates.
+	off := maxD + 1
+	forward := make([]int, 2*off+1)
+	backward := make([]int, 2*off+1)
+
+	for step := 0; step <= maxD; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && forward[off+k-1] < forward[off+k+1]) {
+				x = forward[off+k+1]
+			} else {
+				x = forward[off+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			forward[off+k] = x
+			if rk := delta - k; odd && rk >= -(step-1) && rk <= step-1 && x+backward[off+rk] >= n {
+				return aLo + startX, bLo + startY
+			}
+		}
+
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && backward[off+k-1] < backward[off+k+1]) {
+				x = backward[off+k+1]
+			} else {
+				x = backward[off+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+			backward[off+k] = x
+			if fk := delta - k; !odd && fk >= -step && fk <= step && x+forward[off+fk] >= n {
+				return aHi - startX, bHi - startY
+			}
+		}
+	}
+
+	// The searches always meet by the time step reaches maxD.
+	panic("diff: forward and backward searches did not overlap")
+}
+
+// writeHunks writes the changes in script as unified diff hunks, each with up
+// to context lines of unchanged text around it.
+func writeHunks(b *strings.Builder, script []diffLine, context int) {
+	if context < 0 {
+		context = 0
+	}
+
+	// oldLine[i] and newLine[i] count the lines of each side that precede
+	// script[i].
+	oldLine := make([]int, len(script)+1)
+	newLine := make([]int, len(script)+1)
+	for i, line := range script {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if line.kind != '+' {
+			oldLine[i+1]++
+		}
+		if line.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(script); {
+		if script[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk over every change separated by no more than
+		// 2*context unchanged lines.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(script); j++ {
+			if script[j].kind == ' ' {
+				continue
+			}
+			if j-end > 2*context {
+				break
+			}
+			end = j + 1
+		}
+		end += context
+		if end > len(script) {
+			end = len(script)
+		}
+
+		fmt.Fprintf(b, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]))
+		for _, line := range script[start:end] {
+			b.WriteByte(line.kind)
+			b.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+}
+
+// hunkRange formats one side of a hunk header given the number of lines that
+// precede the hunk and the number of lines it spans.
+func hunkRange(before int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, count)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assertDiff ensures that printing a patch from old to new produces want.
+func assertDiff(t *testing.T, context int, old string, new string, want string) {
+	t.Helper()
+	var buf bytes.Buffer
+	d := diffPrinter{w: &buf, context: context, base: "/base"}
+	if err := d.printFile("/base/file", "/base/file", old, new); err != nil {
+		t.Fatalf("printFile: %v", err)
+	}
+	header := "diff --git a/file b/file\n--- a/file\n+++ b/file\n"
+	if got := buf.String(); got != header+want {
+		t.Errorf("diff of %q to %q =\n%s\nwant\n%s", old, new, got, header+want)
+	}
+}
+
+func TestDiffSingleLine(t *testing.T) {
+	assertDiff(t, 3, "alpha\n", "beta\n", "@@ -1 +1 @@\n-alpha\n+beta\n")
+}
+
+func TestDiffNoTrailingNewline(t *testing.T) {
+	assertDiff(t, 3, "alpha", "beta",
+		"@@ -1 +1 @@\n-alpha\n\\ No newline at end of file\n+beta\n\\ No newline at end of file\n")
+}
+
+func TestDiffContextLines(t *testing.T) {
+	old := "1\n2\n3\nalpha\n5\n6\n7\n"
+	new := "1\n2\n3\nbeta\n5\n6\n7\n"
+	assertDiff(t, 1, old, new, "@@ -3,3 +3,3 @@\n 3\n-alpha\n+beta\n 5\n")
+	assertDiff(t, 0, old, new, "@@ -4 +4 @@\n-alpha\n+beta\n")
+}
+
+func TestDiffSeparateHunks(t *testing.T) {
+	old := "alpha\n2\n3\n4\n5\nalpha\n"
+	new := "beta\n2\n3\n4\n5\nbeta\n"
+	assertDiff(t, 1, old, new, "@@ -1,2 +1,2 @@\n-alpha\n+beta\n 2\n@@ -5,2 +5,2 @@\n 5\n-alpha\n+beta\n")
+	// With enough context the two changes merge into a single hunk.
+	assertDiff(t, 2, old, new, "@@ -1,6 +1,6 @@\n-alpha\n+beta\n 2\n 3\n 4\n 5\n-alpha\n+beta\n")
+}
+
+func TestDiffInsertedLines(t *testing.T) {
+	assertDiff(t, 3, "a\nb\n", "a\nx\ny\nb\n", "@@ -1,2 +1,4 @@\n a\n+x\n+y\n b\n")
+}
+
+func TestDiffDeletedLines(t *testing.T) {
+	assertDiff(t, 0, "a\nx\ny\nb\n", "a\nb\n", "@@ -2,2 +1,0 @@\n-x\n-y\n")
+}
+
+func TestDiffRenameOnly(t *testing.T) {
+	var buf bytes.Buffer
+	d := diffPrinter{w: &buf, context: 3, base: "/base"}
+	if err := d.printFile("/base/alpha/file", "/base/beta/file", "", ""); err != nil {
+		t.Fatalf("printFile: %v", err)
+	}
+	want := "diff --git a/alpha/file b/beta/file\nrename from alpha/file\nrename to beta/file\n"
+	if got := buf.String(); got != want {
+		t.Errorf("rename diff =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestDiffLinesIsMinimal ensures the edit script reproduces both sides and
+// contains no more edits than necessary.
+func TestDiffLinesIsMinimal(t *testing.T) {
+	a := splitLines("a\nb\nc\na\nb\nb\na\n")
+	b := splitLines("c\nb\na\nb\na\nc\n")
+	script := diffLines(a, b)
+
+	var gotA, gotB []string
+	edits := 0
+	for _, line := range script {
+		if line.kind != '+' {
+			gotA = append(gotA, line.text)
+		}
+		if line.kind != '-' {
+			gotB = append(gotB, line.text)
+		}
+		if line.kind != ' ' {
+			edits++
+		}
+	}
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Fatalf("edit script %v does not reproduce its inputs", script)
+	}
+	// This is the example from Myers' paper, whose shortest edit script
+	// has length 5.
+	if edits != 5 {
+		t.Errorf("edit script has %d edits; want 5", edits)
+	}
+}
+
+// TestRun_DiffAppliesWithPatch runs a dry run with --diff and confirms that
+// applying the resulting patch to a copy of the tree with `patch -p1` gives
+// the same result as a real run.
+func TestRun_DiffAppliesWithPatch(t *testing.T) {
+	patchPath, err := exec.LookPath("patch")
+	if err != nil {
+		t.Skip("patch is not installed")
+	}
+
+	files := map[string]string{
+		"top.txt":             "no trailing newline alpha",
+		"alpha/keep":          "unchanged\n",
+		"alpha/sub/alpha.txt": "1\nalpha\n3\n4\n5\n6\n7\n8\n9\nalpha\n",
+	}
+	newTree := func() string {
+		dir := t.TempDir()
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("WriteFile(%q): %v", path, err)
+			}
+		}
+		return dir
+	}
+	previewed, patched := newTree(), newTree()
+	captureLog(t)
+
+	withWorkingDir(t, previewed)
+	var patch, stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--dry-run", "--diff", "alpha", "beta"}, nil, &patch, &stderr); got != 0 {
+		t.Fatalf("dry run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	if got := run([]string{"find-replace", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+
+	cmd := exec.Command(patchPath, "-p1")
+	cmd.Dir = patched
+	cmd.Stdin = &patch
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch -p1: %v\n%s\npatch was:\n%s", err, out, patch.String())
+	}
+
+	for _, name := range []string{"top.txt", "beta/keep", "beta/sub/beta.txt"} {
+		want, err := os.ReadFile(filepath.Join(previewed, name))
+		if err != nil {
+			t.Fatalf("ReadFile after run: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(patched, name))
+		if err != nil {
+			t.Errorf("ReadFile after patch: %v", err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("patched %v = %q; want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(patched, "alpha")); err == nil {
+		t.Errorf("patched tree still contains alpha/ after its files were renamed")
+	}
+}
+
+// TestRun_DiffMovesExcludedFiles confirms that files left alone by
+// --exclude, but inside a directory that is renamed, are described as moving
+// with it.
+func TestRun_DiffMovesExcludedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"alpha/vendor/lib.txt": "alpha",
+		"alpha/notes.md":       "alpha",
+	})
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var patch, stderr bytes.Buffer
+	args := []string{"find-replace", "--dry-run", "--diff", "--exclude", "vendor", "--exclude", "*.md", "alpha", "beta"}
+	if got := run(args, nil, &patch, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	for _, want := range []string{
+		"rename from alpha/vendor/lib.txt\nrename to beta/vendor/lib.txt\n",
+		"rename from alpha/notes.md\nrename to beta/notes.md\n",
+	} {
+		if !strings.Contains(patch.String(), want) {
+			t.Errorf("patch =\n%s\nwant it to contain\n%s", patch.String(), want)
+		}
+	}
+	if strings.Contains(patch.String(), "+beta") {
+		t.Errorf("patch =\n%s\nwant excluded contents left alone", patch.String())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fsyncFile flushes the contents of the file at path to stable storage, so
+// that a crash can't leave it empty or half written once it has replaced
+// another.
+func fsyncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("sync %v: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync %v: %w", path, err)
+	}
+	return nil
+}
+
+// fsyncDir flushes the entries of the directory at path to stable storage,
+// so that a crash can't undo a rename into it. Windows, and some file
+// systems, can't sync directories; there, this does nothing.
+func fsyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("sync directory %v: %w", path, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return fmt.Errorf("sync directory %v: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsync(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"file.txt": "alpha"})
+	if err := fsyncFile(filepath.Join(dir, "file.txt")); err != nil {
+		t.Errorf("fsyncFile: %v", err)
+	}
+	if err := fsyncDir(dir); err != nil {
+		t.Errorf("fsyncDir: %v", err)
+	}
+	if err := fsyncFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("fsyncFile of a missing file = nil; want an error")
+	}
+}
+
+func TestRun_NoFsync(t *testing.T) {
+	for _, args := range [][]string{
+		{"--no-fsync"},
+		{"--no-fsync", "--atomic"},
+		{"--atomic"},
+	} {
+		dir := t.TempDir()
+		writeTree(t, dir, map[string]string{"alpha/file.txt": "alpha"})
+		withWorkingDir(t, dir)
+		captureLog(t)
+
+		runOrFatal(t, append(args, "alpha", "beta")...)
+		assertTree(t, dir, map[string]string{"beta/file.txt": "beta"})
+	}
+}
+
+// BenchmarkDurability measures what syncing each rewrite and rename to disk
+// costs, by rewriting and renaming a directory of small files with and
+// without --no-fsync.
+func BenchmarkDurability(b *testing.B) {
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(prev)
+
+	for _, fsync := range []bool{true, false} {
+		name := "fsync"
+		args := []string{"find-replace", "--no-journal"}
+		if !fsync {
+			name = "no-fsync"
+			args = append(args, "--no-fsync")
+		}
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				dir := b.TempDir()
+				for i := 0; i < 100; i++ {
+					path := filepath.Join(dir, fmt.Sprintf("alpha-%d.txt", i))
+					if err := os.WriteFile(path, []byte("alpha\n"), 0600); err != nil {
+						b.Fatalf("WriteFile: %v", err)
+					}
+				}
+				b.StartTimer()
+
+				var stderr bytes.Buffer
+				if code := run(append(args, "alpha", "beta", dir), nil, io.Discard, &stderr); code != 0 {
+					b.Fatalf("run = %d; want 0 (stderr: %q)", code, stderr.String())
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,6 +14,39 @@ import (
 type File struct {
 	Path string
 	info os.FileInfo
+
+	// parent is the directory this file was found in by WalkDir, or nil if
+	// the file was not discovered by a walk.
+	parent *File
+
+	// planned is where a directory will end up once the walk completes,
+	// recorded before its children are visited (during dry runs, and when
+	// printing a patch) so they can report their final paths.
+	planned string
+
+	// diffed is set once the file has been described in a patch, so that
+	// RenameFile does not describe it a second time.
+	diffed bool
+
+	// asked and approved remember the operator's answer when asked, in
+	// --interactive mode, whether the file may be renamed.
+	asked    bool
+	approved bool
+
+	// ignores holds the ignore files that apply to a directory's children,
+	// loaded by WalkDir before they are visited.
+	ignores []*ignoreFile
+
+	// binary is set once OpenText has found that the file is not text.
+	binary bool
+
+	// renamed is f's new name, once RenameFile has renamed it (or, under
+	// --atomic, planned to).
+	renamed string
+
+	// real is the path with symlinks resolved, recorded for the roots of a
+	// walk and for symlinks followed to a directory. See realPath.
+	real string
 }
 
 // NewFile resolves path to an absolute path and wraps it in a *File. It
@@ -27,6 +60,28 @@ func NewFile(path string) (*File, error) {
 	return &File{Path: absPath}, nil
 }
 
+// child returns a *File for the entry named baseName inside directory f.
+func (f *File) child(baseName string) *File {
+	return &File{Path: filepath.Join(f.Path, baseName), parent: f}
+}
+
+// relPath returns f's slash-separated path relative to the root of the walk
+// that found it. A file that was not found by a walk, such as one named on
+// the command line, is relative to its own directory.
+func (f *File) relPath() string {
+	var segments []string
+	for p := f; p.parent != nil; p = p.parent {
+		segments = append(segments, p.Base())
+	}
+	if len(segments) == 0 {
+		return f.Base()
+	}
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return strings.Join(segments, "/")
+}
+
 func (f *File) Base() string {
 	return filepath.Base(f.Path)
 }
@@ -35,11 +90,47 @@ func (f *File) Dir() string {
 	return filepath.Dir(f.Path)
 }
 
-// Info lazily stats the file and caches the result. It returns an error if
-// the underlying os.Stat fails.
+// realPath returns f's absolute path with symlinks resolved, derived from the
+// resolved path of the nearest directory above it that recorded one.
+func (f *File) realPath() string {
+	if f.real != "" {
+		return f.real
+	}
+	if f.parent == nil {
+		return f.Path
+	}
+	return filepath.Join(f.parent.realPath(), f.Base())
+}
+
+// currentPath returns where f is now that it, and the directories above it,
+// may have been renamed since the walk found it.
+func (f *File) currentPath() string {
+	base := f.Base()
+	if f.renamed != "" {
+		base = f.renamed
+	}
+	if f.parent == nil {
+		return filepath.Join(f.Dir(), base)
+	}
+	return filepath.Join(f.parent.currentPath(), base)
+}
+
+// finalDir returns the directory f will occupy once the walk completes. It
+// only differs from Dir when HandleFile has recorded the planned path of the
+// directories above f before descending into them.
+func (f *File) finalDir() string {
+	if f.parent != nil && f.parent.planned != "" {
+		return f.parent.planned
+	}
+	return f.Dir()
+}
+
+// Info lazily stats the file and caches the result. A symlink is described
+// by the link itself, not its target, unless the walk has decided to follow
+// it. It returns an error if the underlying os.Lstat fails.
 func (f *File) Info() (os.FileInfo, error) {
 	if f.info == nil {
-		stat, err := os.Stat(f.Path)
+		stat, err := os.Lstat(f.Path)
 		if err != nil {
 			return nil, fmt.Errorf("stat %v: %w", f.Path, err)
 		}
@@ -48,38 +139,40 @@ func (f *File) Info() (os.FileInfo, error) {
 	return f.info, nil
 }
 
-// Mode returns the cached mode bits. It is only safe to call after Info() has
-// succeeded; callers that have a *File handed to them by the walker can rely
-// on that precondition because the walker calls Info() before dispatching.
-func (f *File) Mode() (os.FileMode, error) {
-	info, err := f.Info()
-	if err != nil {
-		return 0, err
-	}
-	return info.Mode(), nil
-}
-
-// Read reads the file into a string, or returns the empty string for binary
-// files. An error indicates the file could not be opened or fully read; the
-// caller should log-and-skip rather than abort.
-func (f *File) Read() (string, error) {
+// OpenText opens the file for reading, or returns nil for binary files (and
+// marks f as binary). The caller must close the returned file.
+func (f *File) OpenText() (*os.File, error) {
 	handle, err := os.Open(f.Path)
 	if err != nil {
-		return "", fmt.Errorf("open %v: %w", f.Path, err)
+		return nil, fmt.Errorf("open %v: %w", f.Path, err)
 	}
-	defer handle.Close()
 
 	// Check if the file looks like text before reading the entire file.
 	var buf [1024]byte
 	n, err := handle.Read(buf[0:])
 	if err != nil || !util.IsText(buf[0:n]) {
-		return "", nil
+		handle.Close()
+		f.binary = err == nil
+		return nil, nil
 	}
 
-	// Reset file handle so we can read the entire file.
+	// Reset file handle so the caller can read the entire file.
 	if _, err := handle.Seek(0, io.SeekStart); err != nil {
-		return "", fmt.Errorf("seek to start of %v: %w", f.Path, err)
+		handle.Close()
+		return nil, fmt.Errorf("seek to start of %v: %w", f.Path, err)
 	}
+	return handle, nil
+}
+
+// Read reads the file into a string, or returns the empty string for binary
+// files. An error indicates the file could not be opened or fully read; the
+// caller should log-and-skip rather than abort.
+func (f *File) Read() (string, error) {
+	handle, err := f.OpenText()
+	if err != nil || handle == nil {
+		return "", err
+	}
+	defer handle.Close()
 
 	builder := new(strings.Builder)
 	if _, err := io.Copy(builder, handle); err != nil {
@@ -88,28 +181,85 @@ func (f *File) Read() (string, error) {
 	return builder.String(), nil
 }
 
-// Write atomically replaces the file with content, via a temp file + rename.
-// A deferred os.Remove(tempName) ensures the temp file is cleaned up if any
-// step after its creation fails (including the rename); on success the remove
-// is a no-op because the file has already been renamed away.
-func (f *File) Write(content string) error {
-	mode, err := f.Mode()
+// Stage writes content to a new temp file next to the file, with the same
+// mode, owner and extended attributes (see preserveMetadata), and returns its
+// name, for Commit to move into place later.
+func (f *File) Stage(content string) (string, error) {
+	info, err := f.Info()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	tempName := filepath.Join(f.Dir(), RandomString(20))
-	if err := os.WriteFile(tempName, []byte(content), mode); err != nil {
-		return fmt.Errorf("create tempfile in %v: %w", f.Dir(), err)
+	if err := os.WriteFile(tempName, []byte(content), info.Mode()); err != nil {
+		os.Remove(tempName)
+		return "", fmt.Errorf("create tempfile in %v: %w", f.Dir(), err)
 	}
+	if err := preserveMetadata(tempName, f.Path, info); err != nil {
+		os.Remove(tempName)
+		return "", err
+	}
+	return tempName, nil
+}
+
+// Commit atomically replaces the file with the staged temp file tempName. A
+// deferred os.Remove(tempName) ensures the temp file is cleaned up if the
+// rename fails; on success the remove is a no-op because the file has already
+// been renamed away.
+func (f *File) Commit(tempName string) error {
 	// Make sure the temp file is removed if the rename below fails. On
 	// success, the rename has already moved the file to f.Path so this is
 	// a no-op (we deliberately ignore the not-exist error).
 	defer os.Remove(tempName)
 
-	log.Printf("Rewriting %v", f.Path)
 	if err := os.Rename(tempName, f.Path); err != nil {
 		return fmt.Errorf("atomically move temp file %v to %v: %w", tempName, f.Path, err)
 	}
 	return nil
 }
+
+// StageRewrite streams the file through rewrite, which copies src to dst
+// with any changes made along the way, into a new temp file with the same
+// metadata, as in Stage, and returns its name. If rewrite reports that
+// nothing changed, the temp file is removed and the name is empty. Binary
+// files are skipped without calling rewrite.
+func (f *File) StageRewrite(rewrite func(dst io.Writer, src io.Reader) (bool, error)) (string, error) {
+	info, err := f.Info()
+	if err != nil {
+		return "", err
+	}
+	handle, err := f.OpenText()
+	if err != nil || handle == nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	tempName := filepath.Join(f.Dir(), RandomString(20))
+	temp, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return "", fmt.Errorf("create tempfile in %v: %w", f.Dir(), err)
+	}
+
+	w := bufio.NewWriter(temp)
+	changed, err := rewrite(w, bufio.NewReader(handle))
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !changed {
+		os.Remove(tempName)
+	}
+	if err != nil {
+		return "", fmt.Errorf("rewrite %v: %w", f.Path, err)
+	}
+	if !changed {
+		return "", nil
+	}
+	if err := preserveMetadata(tempName, f.Path, info); err != nil {
+		os.Remove(tempName)
+		return "", err
+	}
+	return tempName, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// globPattern is a compiled glob in the style of .gitignore: `*`, `?` and
+// `[...]` match within a single path segment, and a `**` segment matches any
+// number of segments. A pattern containing a slash (other than a trailing
+// one) is anchored to the root it is matched against; otherwise it matches
+// the name of an entry at any depth. A trailing slash matches directories
+// only.
+type globPattern struct {
+	// pattern is the glob as it was written.
+	pattern string
+
+	segments []string
+	dirOnly  bool
+}
+
+// compileGlob parses pattern. It returns an error if any segment of the
+// pattern is malformed.
+func compileGlob(pattern string) (globPattern, error) {
+	g := globPattern{pattern: pattern}
+
+	p := pattern
+	if strings.HasSuffix(p, "/") {
+		g.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return g, fmt.Errorf("invalid glob %q: empty pattern", pattern)
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	g.segments = strings.Split(p, "/")
+	if !anchored {
+		g.segments = append([]string{"**"}, g.segments...)
+	}
+	for _, segment := range g.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return g, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return g, nil
+}
+
+// match reports whether the slash-separated relative path rel matches g.
+func (g globPattern) match(rel string, isDir bool) bool {
+	if g.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(g.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against glob segments, where a "**"
+// glob segment matches zero or more path segments. A trailing "**" must match
+// at least one, so that "dir/**" matches everything inside dir but not dir
+// itself.
+func matchSegments(globs []string, segments []string) bool {
+	for len(globs) > 0 {
+		if globs[0] == "**" {
+			if len(globs) == 1 {
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(globs[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(globs[0], segments[0]); !ok {
+			return false
+		}
+		globs, segments = globs[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// globList is a repeatable command line flag that collects globs.
+type globList []globPattern
+
+func (l *globList) String() string {
+	var patterns []string
+	for _, g := range *l {
+		patterns = append(patterns, g.pattern)
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (l *globList) Set(pattern string) error {
+	g, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, g)
+	return nil
+}
+
+// pathFilter decides which entries of a walk are rewritten and renamed,
+// based on --include and --exclude globs matched against each entry's path
+// relative to the walk root.
+type pathFilter struct {
+	include globList
+	exclude globList
+}
+
+// excludes reports whether the entry at rel matches an --exclude glob.
+// Excluded directories are not entered at all.
+func (pf *pathFilter) excludes(rel string, isDir bool) bool {
+	for _, g := range pf.exclude {
+		if g.match(rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// includes reports whether f should be rewritten and renamed: true if there
+// are no --include globs, or if f or any directory above it (within the walk)
+// matches one. Directories that are not included are still entered, since
+// something beneath them may be.
+func (pf *pathFilter) includes(f *File, isDir bool) bool {
+	if len(pf.include) == 0 {
+		return true
+	}
+	for p := f; p != nil; p = p.parent {
+		if p != f && p.parent == nil {
+			// p is the root of the walk, which is never matched.
+			break
+		}
+		rel := p.relPath()
+		for _, g := range pf.include {
+			if g.match(rel, isDir || p != f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows reports whether f passes the filter as a whole: it is included, and
+// neither it nor any directory above it (within the walk) is excluded.
+func (pf *pathFilter) allows(f *File, isDir bool) bool {
+	for p := f; p != nil; p = p.parent {
+		if p != f && p.parent == nil {
+			break
+		}
+		if pf.excludes(p.relPath(), isDir || p != f) {
+			return false
+		}
+	}
+	return pf.includes(f, isDir)
+}
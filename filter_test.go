@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.go", "main.go", false, true},
+		{"*.go", "pkg/sub/main.go", false, true},
+		{"*.go", "main.go.txt", false, false},
+		{"vendor", "vendor", true, true},
+		{"vendor", "a/vendor", true, true},
+		{"vendor/", "vendor", false, false},
+		{"vendor/", "vendor", true, true},
+		{"/vendor", "a/vendor", true, false},
+		{"/vendor", "vendor", true, true},
+		{"pkg/*.go", "pkg/main.go", false, true},
+		{"pkg/*.go", "pkg/sub/main.go", false, false},
+		{"pkg/*.go", "a/pkg/main.go", false, false},
+		{"pkg/**/*.go", "pkg/main.go", false, true},
+		{"pkg/**/*.go", "pkg/a/b/main.go", false, true},
+		{"**/testdata", "testdata", true, true},
+		{"**/testdata", "a/b/testdata", true, true},
+		{"testdata/**", "testdata/a/b", false, true},
+		{"testdata/**", "testdata", true, false},
+		{"a/**/b", "a/b", true, true},
+		{"a/**/b", "a/x/y/b", true, true},
+		{"a/**/b", "a/x/y/c", true, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file[0-9].txt", "filex.txt", false, false},
+	}
+	for _, tc := range tests {
+		g, err := compileGlob(tc.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", tc.pattern, err)
+		}
+		if got := g.match(tc.rel, tc.isDir); got != tc.want {
+			t.Errorf("glob %q match(%q, isDir=%v) = %v; want %v", tc.pattern, tc.rel, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestCompileGlobInvalid(t *testing.T) {
+	for _, pattern := range []string{"[a-", "/", ""} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("compileGlob(%q): err = nil; want an error", pattern)
+		}
+	}
+}
+
+func TestPathFilterIncludesAncestors(t *testing.T) {
+	var pf pathFilter
+	if err := pf.include.Set("src"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	root := &File{Path: "/root"}
+	src := root.child("src")
+	file := src.child("main.go").child("x")
+	other := root.child("other").child("main.go")
+
+	if !pf.includes(src, true) {
+		t.Errorf("includes(src) = false; want true")
+	}
+	if !pf.includes(file, false) {
+		t.Errorf("includes(src/main.go/x) = false; want true (an ancestor matches)")
+	}
+	if pf.includes(other, false) {
+		t.Errorf("includes(other/main.go) = true; want false")
+	}
+}
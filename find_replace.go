@@ -1,34 +1,131 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 )
 
+// defaultStreamThreshold is the default for --stream-threshold.
+const defaultStreamThreshold = 64 << 20
+
 // findReplace is a struct used to provide context to all find & replace
 // operations, including the strings to search for & replace.
 type findReplace struct {
 	find    string
 	replace string
 
+	// matcher finds occurrences of find in file names and contents. If nil,
+	// find is matched literally.
+	matcher matcher
+
+	// rules, if set, replaces matcher with an ordered list of find/replace
+	// pairs loaded by --rules.
+	rules []rule
+
+	// literalGroups holds the merged matchers of runs of literal rules.
+	literalGroups literalGroups
+
+	// filter limits which paths are rewritten and renamed.
+	filter pathFilter
+
+	// noIgnore walks into paths that .gitignore, .ignore,
+	// .findreplaceignore and git's exclude files would otherwise skip.
+	noIgnore bool
+
+	// dryRun reports every rewrite and rename that would happen without
+	// touching anything on disk.
+	dryRun bool
+
+	// check, if set, reports every match instead of replacing it, without
+	// touching anything on disk, for --check and --list.
+	check *checker
+
+	// report receives every event of the run. If nil, events are printed
+	// as text.
+	report reporter
+
+	// diff, if set, prints a patch describing every rewrite and rename.
+	diff *diffPrinter
+
+	// fsync syncs every rewrite and rename to disk as it is made, so that
+	// a crash can't lose or half apply it.
+	fsync bool
+
+	// preserveMtime keeps the modification time of rewritten files.
+	preserveMtime bool
+
+	// streamThreshold is the size in bytes from which files are streamed
+	// through a fixed-size window instead of being read into memory. Zero
+	// disables streaming.
+	streamThreshold int64
+
+	// prompt, if set, asks the operator to approve each replacement and
+	// rename.
+	prompt *prompter
+
+	// atomic, if set, stages every rewrite and rename of the walk so that
+	// they can be committed together, or not at all.
+	atomic *transaction
+
+	// journal, if set, records every rewrite and rename so that the run can
+	// be undone.
+	journal *journal
+
+	// followSymlinks walks into symlinks to directories, and rewrites the
+	// targets of symlinks to files wherever they are.
+	followSymlinks bool
+
+	// relinkSymlinks applies the replacement to the targets of symlinks,
+	// and reports the symlinks left dangling at the end of the run.
+	relinkSymlinks bool
+
+	// links holds the symlinks the walk came across, for --relink.
+	links linkList
+
+	// rootDirs holds the resolved paths of the directories being walked.
+	rootDirs []string
+
+	// hardlinks is how files with other hard links are rewritten: one of
+	// hardlinksSplit, hardlinksInPlace or hardlinksSkip.
+	hardlinks string
+
+	// inodes records the files with other hard links whose contents have
+	// been handled, by device and inode, for hardlinksInPlace.
+	inodes claimedPaths
+
+	// claimed records the files whose contents have been handled, so that
+	// none is rewritten twice by way of a symlink.
+	claimed claimedPaths
+
+	// workers bounds how many files are handled concurrently.
+	workers workerPool
+
 	// errs accumulates non-fatal errors that occurred during a walk. The
 	// walker logs each error at the point of failure (preserving the
 	// operator-visible UX) and appends it here so main can surface a
 	// non-zero exit code at the end.
 	errs errAccumulator
+
+	// styleHits counts replacements per identifier style, for the summary
+	// printed at the end of an --identifiers run.
+	styleHits hitCounter
 }
 
 // errAccumulator is a tiny thread-safe collector for errors that occur in
 // concurrent walker goroutines. It is intentionally small: just enough to
-// preserve "log everything, exit non-zero if anything failed" semantics
-// without committing the codebase to a particular concurrency primitive
-// (see issue #7 for the eventual bounded worker pool).
+// preserve "log everything, exit non-zero if anything failed" semantics.
 type errAccumulator struct {
 	mu   sync.Mutex
 	errs []error
@@ -57,6 +154,49 @@ func (a *errAccumulator) err() error {
 	return errors.Join(a.errs...)
 }
 
+// hitCounter tallies replacements by identifier style across concurrent
+// walker goroutines.
+type hitCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// add counts each of matches that has a style and was actually replaced.
+func (c *hitCounter) add(matches []match) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range matches {
+		if m.style == "" || m.ambiguous {
+			continue
+		}
+		if c.counts == nil {
+			c.counts = make(map[string]int)
+		}
+		c.counts[m.style]++
+	}
+}
+
+// count returns the number of replacements recorded for style.
+func (c *hitCounter) count(style string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[style]
+}
+
+// merge adds the counts in other to c.
+func (c *hitCounter) merge(other *hitCounter) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for style, n := range other.counts {
+		if c.counts == nil {
+			c.counts = make(map[string]int)
+		}
+		c.counts[style] += n
+	}
+}
+
 // main processes command line arguments, builds the context struct, and begins
 // the process of walking the current working directory.
 //
@@ -66,35 +206,206 @@ func (a *errAccumulator) err() error {
 // • baseName: the relative name of a file, without a directory
 // • path: the relative path to a specific file or directory, including both dirName and baseName
 func main() {
-	os.Exit(run(os.Args, os.Stderr))
+	os.Exit(run(os.Args, os.Stdin, os.Stdout, os.Stderr))
 }
 
 // run is the testable body of main. It returns the process exit code: 0 on
 // clean success, 1 if argument parsing failed or any traversal error was
-// recorded. Output documented in the README (Renaming/Rewriting lines) still
-// goes to log.Default(); usage and aggregated error summaries go to stderr.
-func run(args []string, stderr io.Writer) int {
+// recorded, and exitFound if --check found a match (and nothing failed).
+// Output documented in the README (Renaming/Rewriting lines) still goes to
+// log.Default(); usage and aggregated error summaries go to stderr. Patches
+// requested with --diff, and matches found by --check or --list, go to stdout
+// so they can be redirected. --interactive reads its answers from stdin.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
 	// Remove date/time from logging output.
 	log.SetFlags(0)
 
-	if len(args) != 3 {
-		fmt.Fprintln(stderr, "Usage: find-replace FIND REPLACE")
-		return 1
+	if len(args) > 1 && args[1] == "undo" {
+		return runUndo(args[1:], stdout, stderr)
 	}
 
-	fr := findReplace{find: args[1], replace: args[2]}
+	var fr findReplace
+	flags := flag.NewFlagSet("find-replace", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: find-replace [flags] FIND REPLACE [PATH...]")
+		fmt.Fprintln(stderr, "       find-replace --check|--list [flags] FIND")
+		fmt.Fprintln(stderr, "       find-replace [flags] --rules FILE [PATH...]")
+		fmt.Fprintln(stderr, "       find-replace undo [--force] [--state-dir DIRECTORY]")
+		flags.PrintDefaults()
+	}
+	flags.Var(&fr.filter.include, "include", "only rewrite and rename paths matching this `glob` (repeatable)")
+	flags.Var(&fr.filter.exclude, "exclude", "skip paths matching this `glob`, without entering excluded directories (repeatable)")
+	flags.BoolVar(&fr.noIgnore, "no-ignore", false, "don't skip paths matched by .gitignore, .ignore, .findreplaceignore or git's exclude files")
+	flags.BoolVar(&fr.followSymlinks, "follow-symlinks", false, "walk into symlinked directories, and rewrite symlinked files wherever they point")
+	flags.BoolVar(&fr.relinkSymlinks, "relink", false, "replace FIND in the targets of symlinks too, and warn about symlinks left dangling")
+	flags.StringVar(&fr.hardlinks, "hardlinks", hardlinksSplit, "how to rewrite files with other hard links: `split` them off, write them inplace so every link changes, or skip them")
+	flags.IntVar(&fr.workers.jobs, "jobs", runtime.GOMAXPROCS(0), "handle up to `N` files concurrently")
+	flags.IntVar(&fr.workers.jobs, "j", runtime.GOMAXPROCS(0), "shorthand for --jobs")
+	flags.BoolVar(&fr.dryRun, "dry-run", false, "report planned rewrites and renames without changing anything on disk")
+	check := flags.Bool("check", false, "print every matching path and line without changing anything, and exit 2 if there are any")
+	list := flags.Bool("list", false, "print every match with its line and column, and every matching name, without changing anything")
+	flags.BoolVar(list, "only-matching", false, "same as --list")
+	var opts matchOptions
+	flags.BoolVar(&opts.regexp, "regex", false, "treat FIND as a regular expression, expanding $1 or ${name} in REPLACE")
+	flags.BoolVar(&opts.ignoreCase, "ignore-case", false, "match FIND regardless of case")
+	flags.BoolVar(&opts.ignoreCase, "i", false, "shorthand for --ignore-case")
+	flags.BoolVar(&opts.preserveCase, "preserve-case", false, "match every case variant of FIND and replace each with REPLACE in the same case")
+	flags.BoolVar(&opts.word, "word", false, "only replace matches that sit on word boundaries")
+	flags.StringVar(&opts.wordChars, "word-chars", defaultWordChars, "regular expression character `class` of the characters --word treats as part of a word")
+	flags.BoolVar(&opts.identifiers, "identifiers", false, "treat FIND and REPLACE as word lists, replacing each identifier style (camelCase, snake_case, ...) with the same style")
+	noFsync := flags.Bool("no-fsync", false, "don't wait for each rewrite and rename to reach the disk, which is faster but can lose them in a crash")
+	flags.BoolVar(&fr.preserveMtime, "preserve-mtime", false, "keep the modification time of rewritten files")
+	flags.Int64Var(&fr.streamThreshold, "stream-threshold", defaultStreamThreshold, "stream files of at least this many `bytes` instead of reading them into memory (0 to never stream)")
+	interactive := flags.Bool("interactive", false, "ask before each replacement and rename (handles one file at a time)")
+	atomic := flags.Bool("atomic", false, "stage every rewrite and rename, and only apply them if all of them succeed")
+	noJournal := flags.Bool("no-journal", false, "don't record the changes made, which find-replace undo needs to reverse them")
+	stateDir := flags.String("state-dir", "", "`directory` to keep undo journals in (default $XDG_STATE_HOME/find-replace)")
+	rulesFile := flags.String("rules", "", "apply the find/replace rules in this `file` (JSON, YAML or TOML) in order, instead of FIND and REPLACE")
+	format := flags.String("format", "text", "print events as `text`, or as one JSON object per line (json) to stdout")
+	showDiff := flags.Bool("diff", false, "print a unified diff of every rewrite and rename to stdout")
+	diffContext := flags.Int("diff-context", 3, "number of unchanged `lines` shown around each change in --diff output")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+	var paths []string
+	if *rulesFile != "" {
+		rules, err := loadRules(*rulesFile, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "find-replace: %v\n", err)
+			flags.Usage()
+			return 1
+		}
+		fr.rules = rules
+		paths = flags.Args()
+	} else {
+		// --check and --list replace nothing, so they may be given
+		// FIND alone, which then stands in for REPLACE.
+		if flags.NArg() < 2 && (flags.NArg() == 0 || !*check && !*list) {
+			flags.Usage()
+			return 1
+		}
+		fr.find, fr.replace = flags.Arg(0), flags.Arg(0)
+		if flags.NArg() > 1 {
+			fr.replace = flags.Arg(1)
+			paths = flags.Args()[2:]
+		}
+		if fr.find == "" {
+			fmt.Fprintln(stderr, "find-replace: FIND must not be empty")
+			flags.Usage()
+			return 1
+		}
+		m, err := newMatcher(fr.find, fr.replace, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "find-replace: %v\n", err)
+			flags.Usage()
+			return 1
+		}
+		fr.matcher = m
+	}
+	if fr.streamThreshold < 0 {
+		fmt.Fprintln(stderr, "find-replace: --stream-threshold must not be negative")
+		flags.Usage()
+		return 1
+	}
+	if fr.hardlinks != hardlinksSplit && fr.hardlinks != hardlinksInPlace && fr.hardlinks != hardlinksSkip {
+		fmt.Fprintf(stderr, "find-replace: unknown --hardlinks %q (want split, inplace or skip)\n", fr.hardlinks)
+		flags.Usage()
+		return 1
+	}
+	if fr.workers.jobs < 1 {
+		fmt.Fprintln(stderr, "find-replace: --jobs must be at least 1")
+		flags.Usage()
+		return 1
+	}
 
-	// Recursively explore the hierarchy depth first, rewrite files as needed,
-	// and rename files last (after we don't have to revisit them).
-	// filepath.WalkDir won't work here because it walks files alphabetically,
-	// breadth-first (and you'd be renaming files that you haven't explored
-	// yet).
-	root, err := NewFile(".")
+	report, err := newReporter(*format, stdout)
+	if err == nil && *format == "json" && (*check || *list || *showDiff) {
+		err = errors.New("--format=json cannot be combined with --check, --list or --diff, which print to stdout too")
+	}
 	if err != nil {
-		fmt.Fprintln(stderr, err)
+		fmt.Fprintf(stderr, "find-replace: %v\n", err)
+		flags.Usage()
 		return 1
 	}
-	fr.WalkDir(root)
+	fr.report = report
+
+	if *check || *list {
+		if *interactive || *showDiff {
+			fmt.Fprintln(stderr, "find-replace: --check and --list cannot be combined with --interactive or --diff")
+			flags.Usage()
+			return 1
+		}
+		fr.check = &checker{w: stdout, list: *list, color: isTerminal(stdout)}
+	}
+
+	if *showDiff {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fr.diff = &diffPrinter{w: stdout, context: *diffContext, base: wd}
+	}
+
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	if !fr.dryRun && fr.check == nil && !*noJournal {
+		// Without a journal the run can't be undone, but only a
+		// --state-dir that was asked for is worth stopping over.
+		var err error
+		dir := *stateDir
+		if dir == "" {
+			dir, err = defaultStateDir()
+		}
+		if err == nil {
+			fr.journal, err = openJournal(dir)
+		}
+		if err != nil && *stateDir != "" {
+			fmt.Fprintln(stderr, err)
+			return 1
+		} else if err != nil {
+			fr.reporter().warned("", fmt.Sprintf("Not recording this run for undo: %v", err))
+		}
+	}
+	fr.fsync = !*noFsync
+	if *interactive {
+		fr.prompt = newPrompter(stdin, stderr)
+		fr.workers.jobs = 1
+	}
+	if *atomic && !fr.dryRun && fr.check == nil {
+		fr.atomic = &transaction{fsync: fr.fsync}
+	}
+	fr.Walk(paths)
+	if fr.atomic != nil {
+		fr.finishAtomic()
+	}
+	if fr.relinkSymlinks && (fr.atomic == nil || fr.errs.err() == nil) {
+		// An --atomic run that failed has put everything back where
+		// it was.
+		fr.reportDangling()
+	}
+	if fr.journal != nil {
+		if err := fr.journal.close(); err != nil {
+			fr.fail(err)
+		}
+	}
+
+	showStyles := opts.identifiers
+	for _, r := range fr.rules {
+		showStyles = showStyles || r.identifiers
+	}
+	var styles []styleCount
+	if showStyles {
+		for _, style := range identifierStyles {
+			styles = append(styles, styleCount{style.name, fr.styleHits.count(style.name)})
+		}
+	}
+	fr.reporter().finished(styles)
 
 	if err := fr.errs.err(); err != nil {
 		// Each individual error has already been printed at the point of
@@ -103,42 +414,148 @@ func run(args []string, stderr io.Writer) int {
 		fmt.Fprintln(stderr, err)
 		return 1
 	}
+	if *check && fr.check.foundAny() {
+		return exitFound
+	}
 	return 0
 }
 
+// Walk processes each of paths: directories are walked with WalkDir (but are
+// not themselves renamed), and files are handed straight to HandleFile.
+// Paths that repeat, or sit inside another directory in paths, are skipped
+// so that nothing is processed twice. A path that cannot be resolved is
+// logged and recorded without stopping the others.
+func (fr *findReplace) Walk(paths []string) {
+	// Recursively explore each hierarchy depth first, rewrite files as
+	// needed, and rename files last (after we don't have to revisit them).
+	// filepath.WalkDir won't work here because it walks files
+	// alphabetically, breadth-first (and you'd be renaming files that you
+	// haven't explored yet).
+	for _, root := range fr.roots(paths) {
+		info, err := root.Info()
+		if err != nil {
+			fr.fail(err)
+			continue
+		}
+		if info.IsDir() {
+			fr.WalkDir(root)
+		} else if err := fr.HandleFile(root); err != nil {
+			fr.fail(err)
+		}
+	}
+}
+
+// roots resolves paths to the Files Walk should start from, dropping any
+// path that is the same as, or nested inside, a directory that is also being
+// walked. Paths are compared after resolving symlinks, so two spellings of
+// the same directory are recognized as such. Paths that do not exist are
+// logged and recorded as errors.
+func (fr *findReplace) roots(paths []string) []*File {
+	type root struct {
+		file *File
+		// real is the root's absolute path with symlinks resolved.
+		real string
+		dir  bool
+	}
+
+	var candidates []root
+	for _, path := range paths {
+		f, err := NewFile(path)
+		if err != nil {
+			fr.fail(err)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			fr.fail(err)
+			continue
+		}
+		real, err := filepath.EvalSymlinks(f.Path)
+		if err != nil {
+			err = fmt.Errorf("resolve %v: %w", f.Path, err)
+			fr.fail(err)
+			continue
+		}
+		// A symlink named on the command line is walked like the
+		// directory it points to.
+		if isSymlink(info) {
+			if target, err := os.Stat(real); err == nil && target.IsDir() {
+				f.info, info = target, target
+			}
+		}
+		f.real = real
+		candidates = append(candidates, root{file: f, real: real, dir: info.IsDir()})
+	}
+
+	var files []*File
+	for i, c := range candidates {
+		covered := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			if c.real == other.real && j < i {
+				covered = true
+			} else if other.dir && isWithin(c.real, other.real) {
+				covered = true
+			}
+		}
+		if !covered {
+			files = append(files, c.file)
+			if c.dir {
+				fr.rootDirs = append(fr.rootDirs, c.real)
+			}
+		}
+	}
+	return files
+}
+
+// isWithin reports whether path is strictly inside the directory dir. Both
+// must be clean, absolute paths.
+func isWithin(path string, dir string) bool {
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir) && len(path) > len(dir)
+}
+
 // WalkDir lists files in the directory given by f and dispatches each child
-// to HandleFile in its own goroutine. Per-child errors are logged at their
-// failure site and recorded on fr so main can surface a non-zero exit code.
-// A failure to read the directory itself is recorded and returned to the
-// caller, but does not abort the rest of the walk in any other subtree.
+// to HandleFile, concurrently when fr.workers has a goroutine to spare.
+// Per-child errors are logged at their failure site and recorded on fr so
+// main can surface a non-zero exit code. A failure to read the directory
+// itself is recorded and returned to the caller, but does not abort the rest
+// of the walk in any other subtree.
 func (fr *findReplace) WalkDir(f *File) {
 	var wg sync.WaitGroup
 
+	// Load the ignore files that apply to this directory's children.
+	if !fr.noIgnore {
+		var err error
+		if f.parent == nil {
+			f.ignores, err = loadRootIgnores(f.Path)
+		} else {
+			f.ignores, err = loadDirIgnores(f.Path)
+		}
+		if err != nil {
+			fr.fail(err)
+		}
+	}
+
 	// List the files in this directory.
 	files, err := os.ReadDir(f.Path)
 	if err != nil {
 		wrapped := fmt.Errorf("read directory %v: %w", f.Path, err)
-		log.Print(wrapped)
-		fr.errs.add(wrapped)
+		fr.fail(wrapped)
 		return
 	}
 
 	for _, file := range files {
-		childPath := filepath.Join(f.Path, file.Name())
-		childFile, err := NewFile(childPath)
-		if err != nil {
-			log.Print(err)
-			fr.errs.add(err)
-			continue
-		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		childFile := f.child(file.Name())
+		fr.workers.run(&wg, func() {
 			if err := fr.HandleFile(childFile); err != nil {
-				log.Print(err)
-				fr.errs.add(err)
+				fr.fail(err)
 			}
-		}()
+		})
 	}
 
 	wg.Wait() // for (potentially recursive) calls to return
@@ -149,64 +566,539 @@ func (fr *findReplace) WalkDir(f *File) {
 // complete, the file is renamed (if necessary) since no subsequent operations
 // will need to access it again. Errors from ReplaceContents are not fatal to
 // the rename step; the failure is returned so the walker can log it and
-// continue with siblings.
+// continue with siblings. Entries matching an --exclude glob are skipped
+// entirely, and entries outside every --include glob are neither rewritten
+// nor renamed (though directories are still entered).
 func (fr *findReplace) HandleFile(f *File) error {
 	info, err := f.Info()
 	if err != nil {
 		return err
 	}
 
+	// A symlink is renamed like anything else, but its target is only
+	// walked, or rewritten, where it is safe to.
+	var real string
+	var target os.FileInfo
+	link := isSymlink(info)
+	if link {
+		if real, target, err = resolveLink(f); err != nil {
+			fr.reporter().skipped(f.Path, skipSymlink)
+		} else if target.IsDir() && fr.followsLink(f, real) {
+			f.info, f.real = target, real
+			info = target
+		} else if target.IsDir() {
+			fr.reporter().skipped(f.Path, skipSymlink)
+		}
+	}
+
+	// Ignore certain directories
+	if info.IsDir() && f.Base() == ".git" {
+		return nil
+	}
+	if fr.filter.excludes(f.relPath(), info.IsDir()) {
+		fr.reporter().skipped(f.Path, skipExcluded)
+		return fr.diffMove(f)
+	}
+	if fr.ignored(f, info.IsDir()) {
+		fr.reporter().skipped(f.Path, skipIgnored)
+		return fr.diffMove(f)
+	}
+	included := fr.filter.includes(f, info.IsDir())
+	if !included && !info.IsDir() {
+		fr.reporter().skipped(f.Path, skipExcluded)
+	}
+
 	// If file is a directory, recurse immediately (depth-first).
 	if info.IsDir() {
-		// Ignore certain directories
-		if f.Base() == ".git" {
-			return nil
+		if fr.dryRun || fr.diff != nil {
+			// Record where this directory will end up before descending
+			// into it (nothing moves during a dry run, and a patch
+			// describes each file by its final path), so its children can
+			// report paths beneath the new name.
+			f.planned = filepath.Join(f.finalDir(), f.Base())
+			if newPath, err := fr.renameTarget(f); included && err == nil && newPath != "" && fr.approveRename(f, newPath) {
+				f.planned = filepath.Join(f.finalDir(), filepath.Base(newPath))
+			}
 		}
 		fr.WalkDir(f)
-	} else {
+	} else if included && isSymlink(info) {
+		// Rewrite the file a symlink points to, rather than replacing the
+		// link with a copy of it.
+		if target != nil && !target.IsDir() {
+			if err := fr.rewriteLinkTarget(f, real, target); err != nil {
+				return err
+			}
+		}
+	} else if included && fr.claimed.claim(f.realPath()) {
 		// Replace the contents of regular files.
 		if err := fr.ReplaceContents(f); err != nil {
 			return err
 		}
 	}
 
+	if !included {
+		if fr.diff != nil {
+			// f is left alone, but may still move with a directory
+			// above it.
+			return fr.diffRename(f, "")
+		}
+		return nil
+	}
+
+	if link && fr.relinkSymlinks {
+		if err := fr.relink(f); err != nil {
+			return err
+		}
+		if !fr.dryRun && fr.check == nil {
+			fr.links.add(f)
+		}
+	}
+
 	// Rename the file now that we're otherwise done with it.
 	return fr.RenameFile(f)
 }
 
+// ignored reports whether f is skipped by an ignore file. The ignore files
+// of each directory above f are consulted nearest first, and within a
+// directory in order of precedence; the first file with a pattern matching f
+// decides, and within that file the last matching pattern wins. Paths given
+// explicitly on the command line are never ignored.
+func (fr *findReplace) ignored(f *File, isDir bool) bool {
+	if fr.noIgnore {
+		return false
+	}
+	for dir := f.parent; dir != nil; dir = dir.parent {
+		for _, file := range dir.ignores {
+			if ignored, matched := file.match(f.Path, isDir); matched {
+				return ignored
+			}
+		}
+	}
+	return false
+}
+
 // RenameFile renames f to its post-replacement name if (a) the name actually
 // changes and (b) no file already exists at the destination. It returns an
 // error if the destination is occupied or if the os.Rename itself fails.
+// During a dry run the rename is only reported, using the path f would have
+// once every enclosing directory has been renamed too. Under --check or
+// --list, a name that matches is reported whether or not it could be renamed.
 func (fr *findReplace) RenameFile(f *File) error {
-	newBaseName := strings.ReplaceAll(f.Base(), fr.find, fr.replace)
-	if f.Base() == newBaseName {
+	if fr.check != nil {
+		var all []match
+		for _, matches := range fr.scanRules(f, f.Base(), true) {
+			fr.reportAmbiguousName(f.Path, f.Base(), matches)
+			all = append(all, matches...)
+		}
+		if len(all) > 0 {
+			fr.check.report([]string{fr.check.nameLine(f.Path)})
+			fr.styleHits.add(all)
+		}
 		return nil
 	}
+	_, matches := fr.applyRules(f, f.Base(), true, func(name string, matches []match) []match {
+		fr.reportAmbiguousName(f.Path, name, matches)
+		return matches
+	})
+	newPath, err := fr.renameTarget(f)
+	if err != nil {
+		return err
+	}
+	if newPath != "" && !fr.approveRename(f, newPath) {
+		newPath = ""
+	}
+	if fr.diff != nil && !f.diffed {
+		if err := fr.diffRename(f, newPath); err != nil {
+			return err
+		}
+	}
+	if newPath == "" {
+		return nil
+	}
+	newBaseName := filepath.Base(newPath)
 
-	newPath := filepath.Join(f.Dir(), newBaseName)
-	if _, err := os.Stat(newPath); err == nil {
-		return fmt.Errorf("refusing to rename %v to %v: %v already exists", f.Path, newBaseName, newPath)
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("stat rename destination %v: %w", newPath, err)
+	if fr.dryRun {
+		fr.reporter().renamed(f.Path, filepath.Join(f.finalDir(), newBaseName), true)
+		fr.styleHits.add(matches)
+		return nil
+	}
+
+	if fr.atomic != nil {
+		if err := fr.atomic.planRename(f.Path, newPath); err != nil {
+			return err
+		}
+		f.renamed = newBaseName
+		fr.styleHits.add(matches)
+		return nil
 	}
 
-	log.Printf("Renaming %v to %v", f.Path, newBaseName)
 	if err := os.Rename(f.Path, newPath); err != nil {
 		return fmt.Errorf("rename %v to %v: %w", f.Path, newBaseName, err)
 	}
+	f.renamed = newBaseName
+	fr.reporter().renamed(f.Path, newPath, false)
+	fr.styleHits.add(matches)
+	if fr.journal != nil {
+		if err := fr.journal.renamed(f.Path, newPath); err != nil {
+			return err
+		}
+	}
+	if fr.fsync {
+		return fsyncDir(f.Dir())
+	}
 	return nil
 }
 
-// ReplaceContents rewrites the file at f if its contents contain the find
-// string. Binary-looking files (where Read returns "") are skipped silently.
+// getMatcher returns fr.matcher, or a literal matcher for find if it is nil.
+func (fr *findReplace) getMatcher() matcher {
+	if fr.matcher == nil {
+		return literalMatcher{find: fr.find, replace: fr.replace}
+	}
+	return fr.matcher
+}
+
+// reportAmbiguous logs every match in content, the contents of path, that
+// the matcher could not work out a replacement for, with its line number, so
+// the operator can fix them by hand.
+func (fr *findReplace) reportAmbiguous(path string, content string, matches []match) {
+	fr.reportAmbiguousFrom(path, content, 1, matches)
+}
+
+// reportAmbiguousName is reportAmbiguous for matches in name, the (possibly
+// already partly replaced) name of path.
+func (fr *findReplace) reportAmbiguousName(path string, name string, matches []match) {
+	for _, m := range matches {
+		if m.ambiguous {
+			fr.reporter().warned(path, fmt.Sprintf("Not replacing %q in %v: case is ambiguous", name[m.start:m.end], path))
+		}
+	}
+}
+
+// reportAmbiguousFrom is reportAmbiguous for content that starts on the given
+// line of path.
+func (fr *findReplace) reportAmbiguousFrom(path string, content string, line int, matches []match) {
+	for _, m := range matches {
+		if !m.ambiguous {
+			continue
+		}
+		at := line + strings.Count(content[:m.start], "\n")
+		fr.reporter().warned(path, fmt.Sprintf("Not replacing %q at %v:%d: case is ambiguous", content[m.start:m.end], path, at))
+	}
+}
+
+// renameTarget returns the path f would be renamed to, or "" if its name
+// does not change. It returns an error if the destination is already
+// occupied, since RenameFile refuses to clobber existing files.
+func (fr *findReplace) renameTarget(f *File) (string, error) {
+	newBaseName, _ := fr.applyRules(f, f.Base(), true, nil)
+	if f.Base() == newBaseName {
+		return "", nil
+	}
+	if newBaseName == "" || newBaseName == "." || newBaseName == ".." || strings.ContainsRune(newBaseName, filepath.Separator) {
+		return "", fmt.Errorf("refusing to rename %v to %q: not a valid file name", f.Path, newBaseName)
+	}
+
+	newPath := filepath.Join(f.Dir(), newBaseName)
+	if _, err := os.Lstat(newPath); err == nil {
+		return "", fmt.Errorf("refusing to rename %v to %v: %v already exists", f.Path, newBaseName, newPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("stat rename destination %v: %w", newPath, err)
+	}
+	return newPath, nil
+}
+
+// diffRename prints a pure rename to the patch for a file that will end up at
+// a different path, either because it is renamed to newPath or because a
+// directory above it is. Directories are implicit in a patch, so they are
+// skipped.
+func (fr *findReplace) diffRename(f *File, newPath string) error {
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	final := finalPath(f, newPath)
+	if final == f.Path {
+		return nil
+	}
+	return fr.diff.printFile(f.Path, final, "", "")
+}
+
+// diffMove describes, in the patch, every file at or beneath f that is not
+// otherwise being changed but moves because a directory above it is renamed.
+func (fr *findReplace) diffMove(f *File) error {
+	if fr.diff == nil || f.finalDir() == f.Dir() {
+		return nil
+	}
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fr.diffRename(f, "")
+	}
+
+	final := finalPath(f, "")
+	return filepath.WalkDir(f.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(f.Path, path)
+		if err != nil {
+			return err
+		}
+		return fr.diff.printFile(path, filepath.Join(final, rel), "", "")
+	})
+}
+
+// finalPath returns where f will end up once the walk completes, given the
+// path RenameFile will move it to (or "" if its own name does not change).
+func finalPath(f *File, newPath string) string {
+	if newPath == "" {
+		return filepath.Join(f.finalDir(), f.Base())
+	}
+	return filepath.Join(f.finalDir(), filepath.Base(newPath))
+}
+
+// ReplaceContents rewrites the file at f if its contents match the find
+// pattern. Binary-looking files (where Read returns "") are skipped silently.
+// During a dry run the rewrite is only reported, and under --check or --list
+// the matches are reported instead. Files of at least fr.streamThreshold
+// bytes are streamed rather than read into memory, when the matcher allows it
+// and no diff is being printed. Files with other hard links are handled as
+// --hardlinks says.
 func (fr *findReplace) ReplaceContents(f *File) error {
+	rules := fr.rulesFor(f, false)
+	if len(rules) == 0 || !fr.claimHardlinks(f) {
+		return nil
+	}
+	if fr.streams(f, rules) {
+		return fr.streamContents(f, rules[0].matcher)
+	}
 	content, err := f.Read()
 	if err != nil {
 		return err
 	}
-	if !strings.Contains(content, fr.find) {
+	if f.binary {
+		fr.reporter().skipped(f.Path, skipBinary)
 		return nil
 	}
-	newContent := strings.ReplaceAll(content, fr.find, fr.replace)
-	return f.Write(newContent)
+	fr.reporter().scanned(f.Path)
+	if fr.check != nil {
+		var found []string
+		for _, matches := range fr.scanRules(f, content, false) {
+			found = append(found, fr.check.contentLines(f.Path, content, matches)...)
+			fr.styleHits.add(matches)
+		}
+		fr.check.report(found)
+		return nil
+	}
+	newContent, matches := fr.applyRules(f, content, false, func(content string, matches []match) []match {
+		fr.reportAmbiguous(f.Path, content, matches)
+		if fr.prompt != nil {
+			matches = fr.prompt.approveMatches(f.Path, content, matches)
+		}
+		return matches
+	})
+	if newContent == content {
+		return nil
+	}
+	if fr.diff != nil {
+		// Ask about the rename now, rather than after the patch already
+		// says whether the file is renamed.
+		newPath, _ := fr.renameTarget(f)
+		if newPath != "" && !fr.approveRename(f, newPath) {
+			newPath = ""
+		}
+		if err := fr.diff.printFile(f.Path, finalPath(f, newPath), content, newContent); err != nil {
+			return err
+		}
+		f.diffed = true
+	}
+	stats := rewriteStats{matches: countReplaced(matches), bytesBefore: int64(len(content)), bytesAfter: int64(len(newContent))}
+	if fr.dryRun {
+		fr.reporter().rewrote(f.Path, stats, true)
+		fr.styleHits.add(matches)
+		return nil
+	}
+	var before, after string
+	if fr.journal != nil {
+		if before, err = fr.journal.saveBlob(content); err != nil {
+			return err
+		}
+		after = checksum(newContent)
+	}
+	tempName, err := f.Stage(newContent)
+	if err != nil {
+		return err
+	}
+	if err := fr.commitWrite(f, tempName, before, after, stats); err != nil {
+		return err
+	}
+	fr.styleHits.add(matches)
+	return nil
+}
+
+// streams reports whether ReplaceContents should stream f, given the rules
+// that apply to it. Only a single rule can be streamed.
+func (fr *findReplace) streams(f *File, rules []rule) bool {
+	if fr.streamThreshold <= 0 || fr.diff != nil || fr.prompt != nil || fr.check != nil || len(rules) != 1 || !streamable(rules[0].matcher) {
+		return false
+	}
+	info, err := f.Info()
+	return err == nil && info.Size() >= fr.streamThreshold
+}
+
+// streamContents is ReplaceContents for files too large to hold in memory: f
+// is streamed through streamReplace with m into a temp file, which only
+// replaces f if something changed.
+func (fr *findReplace) streamContents(f *File, m matcher) error {
+	var hits hitCounter
+	var stats rewriteStats
+	if info, err := f.Info(); err == nil {
+		stats.bytesBefore = info.Size()
+	}
+	rewrite := func(dst io.Writer, src io.Reader) (bool, error) {
+		counter := &countingWriter{w: dst}
+		defer func() { stats.bytesAfter = counter.n }()
+		return streamReplace(counter, src, m, func(window string, line int, matches []match) {
+			fr.reportAmbiguousFrom(f.Path, window, line, matches)
+			hits.add(matches)
+			stats.matches += countReplaced(matches)
+		})
+	}
+
+	if fr.dryRun {
+		handle, err := f.OpenText()
+		if err != nil {
+			return err
+		}
+		if handle == nil {
+			fr.reporter().skipped(f.Path, skipBinary)
+			return nil
+		}
+		defer handle.Close()
+		fr.reporter().scanned(f.Path)
+		changed, err := rewrite(io.Discard, bufio.NewReader(handle))
+		if err != nil {
+			return fmt.Errorf("read %v: %w", f.Path, err)
+		}
+		if changed {
+			fr.reporter().rewrote(f.Path, stats, true)
+			fr.styleHits.merge(&hits)
+		}
+		return nil
+	}
+
+	// When journaling, save the original contents as they stream past, and
+	// checksum what replaces them.
+	var blob *blobWriter
+	after := sha256.New()
+	if fr.journal != nil {
+		var err error
+		if blob, err = fr.journal.newBlob(); err != nil {
+			return err
+		}
+	}
+	tempName, err := f.StageRewrite(func(dst io.Writer, src io.Reader) (bool, error) {
+		if blob != nil {
+			dst, src = io.MultiWriter(dst, after), io.TeeReader(src, blob)
+		}
+		return rewrite(dst, src)
+	})
+	if f.binary {
+		fr.reporter().skipped(f.Path, skipBinary)
+	} else if err == nil {
+		fr.reporter().scanned(f.Path)
+	}
+	if err != nil || tempName == "" {
+		if blob != nil {
+			blob.abort()
+		}
+		return err
+	}
+	var before string
+	if blob != nil {
+		if before, err = blob.commit(); err != nil {
+			os.Remove(tempName)
+			return err
+		}
+	}
+	if err := fr.commitWrite(f, tempName, before, hex.EncodeToString(after.Sum(nil)), stats); err != nil {
+		return err
+	}
+	fr.styleHits.merge(&hits)
+	return nil
+}
+
+// commitWrite moves the rewrite of f staged in tempName into place (keeping
+// f's modification time, for --preserve-mtime), or copies it in for
+// --hardlinks=inplace, reports it with stats, and records it in the journal,
+// where before and after are the checksums of the original and rewritten
+// contents. Unless --no-fsync is given, the rewrite is synced to disk, before
+// and after it replaces f. In --atomic mode the rewrite stays staged until
+// the whole run is committed.
+func (fr *findReplace) commitWrite(f *File, tempName string, before string, after string, stats rewriteStats) error {
+	if fr.preserveMtime {
+		info, err := f.Info()
+		if err == nil {
+			err = preserveModTime(tempName, f.Path, info)
+		}
+		if err != nil {
+			os.Remove(tempName)
+			return err
+		}
+	}
+	if fr.fsync {
+		// Make sure the new contents are on disk before they replace
+		// the old.
+		if err := fsyncFile(tempName); err != nil {
+			os.Remove(tempName)
+			return err
+		}
+	}
+	inPlace := fr.writesInPlace(f)
+	if fr.atomic != nil {
+		fr.atomic.stageWrite(f.Path, tempName, before, after, stats, inPlace)
+		return nil
+	}
+	commit := f.Commit
+	if inPlace {
+		commit = f.CommitInPlace
+	}
+	if err := commit(tempName); err != nil {
+		return err
+	}
+	fr.reporter().rewrote(f.Path, stats, false)
+	if fr.journal != nil {
+		if err := fr.journal.rewrote(f.Path, before, after); err != nil {
+			return err
+		}
+	}
+	if fr.fsync && inPlace {
+		return fsyncFile(f.Path)
+	} else if fr.fsync {
+		return fsyncDir(f.Dir())
+	}
+	return nil
+}
+
+// countReplaced returns how many of matches are actually replaced, leaving
+// out the ambiguous ones.
+func countReplaced(matches []match) int {
+	n := 0
+	for _, m := range matches {
+		if !m.ambiguous {
+			n++
+		}
+	}
+	return n
 }
@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"errors"
+	"io"
 	"io/fs"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
@@ -16,6 +19,19 @@ import (
  * Testing utilities
  */
 
+// TestMain keeps the undo journals recorded by test runs out of the real
+// state directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "find-replace-state")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 // newTestFile creates a file in the given directory path, with the given name
 // and content. If a directory path is not provided, a temp directory is used.
 // If a baseName is not provided, a random file name is generated. Returns the
@@ -390,6 +406,492 @@ func TestReplaceContentsNoMatches(t *testing.T) {
 	assertNewContentsOfFile(t, f.Path, initial, find, replace, want)
 }
 
+func TestReplaceContents_Streamed(t *testing.T) {
+	defer func(size int) { streamChunkSize = size }(streamChunkSize)
+	streamChunkSize = 3
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"file": "alpha alpha\nalphalpha"})
+	f := newFileOrFatal(t, filepath.Join(dir, "file"))
+	captureLog(t)
+
+	fr := findReplace{find: "alpha", replace: "beta", streamThreshold: 1, dryRun: true}
+	if err := fr.ReplaceContents(f); err != nil {
+		t.Fatalf("ReplaceContents (dry run): %v", err)
+	}
+	assertTree(t, dir, map[string]string{"file": "alpha alpha\nalphalpha"})
+
+	fr.dryRun = false
+	if err := fr.ReplaceContents(f); err != nil {
+		t.Fatalf("ReplaceContents: %v", err)
+	}
+	assertTree(t, dir, map[string]string{"file": "beta beta\nbetalpha"})
+}
+
+func TestReplaceContentsRegex(t *testing.T) {
+	initial := "v1.2\nv10.20\n"
+	find := `v(\d+)\.(\d+)`
+	replace := "v${1}_$2"
+	want := "v1_2\nv10_20\n"
+
+	f := newTestFile(t, "", "*", initial)
+	defer os.Remove(f.Path)
+	fr := findReplace{find: find, replace: replace, matcher: regexpMatcher{re: regexp.MustCompile(find), replace: replace}}
+	if err := fr.ReplaceContents(f); err != nil {
+		t.Fatalf("ReplaceContents(%q): %v", f.Path, err)
+	}
+	assertNewContentsOfFile(t, f.Path, initial, find, replace, want)
+}
+
+func TestRenameFileRegex(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "release-v1.2.txt")
+	if err := os.WriteFile(src, nil, 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", src, err)
+	}
+
+	find := `v(\d+)\.(\d+)`
+	replace := "v${1}_$2"
+	fr := findReplace{find: find, replace: replace, matcher: regexpMatcher{re: regexp.MustCompile(find), replace: replace}}
+	f := newFileOrFatal(t, src)
+	if err := fr.RenameFile(f); err != nil {
+		t.Fatalf("RenameFile(%q): %v", f.Path, err)
+	}
+	assertPathExistsAfterRename(t, f, filepath.Join(tmp, "release-v1_2.txt"))
+}
+
+// TestWalkDir_IgnoreCase ensures that case-insensitive matching rewrites
+// every case variant of find in both file names and contents.
+func TestWalkDir_IgnoreCase(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"alpha.txt": "alpha Alpha ALPHA",
+		"Alpha.md":  "aLpHa\n",
+		"ALPHA":     "no match here",
+		"Ålpha":     "ÅLPHA ålpha",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v", name, err)
+		}
+	}
+
+	fr := findReplace{find: "alpha", replace: "beta", matcher: newMatcherOrFatal(t, "alpha", "beta", matchOptions{ignoreCase: true})}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	want := map[string]string{
+		"beta.txt": "beta beta beta",
+		"beta.md":  "beta\n",
+		"beta":     "no match here",
+	}
+	for name, content := range want {
+		assertNewContentsOfFile(t, filepath.Join(root, name), files[name], "alpha", "beta", content)
+	}
+
+	// Å is a different letter, not a case variant of a.
+	got, err := os.ReadFile(filepath.Join(root, "Ålpha"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != "ÅLPHA ålpha" {
+		t.Errorf("contents of Ålpha = %q; want them unchanged", got)
+	}
+}
+
+func TestWalkDir_IgnoreCaseUnicodeNames(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "ΣΙΓΜΑ.txt")
+	if err := os.WriteFile(path, []byte("σίγμα Σίγμα"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", path, err)
+	}
+
+	fr := findReplace{find: "σιγμα", replace: "sigma", matcher: newMatcherOrFatal(t, "σιγμα", "sigma", matchOptions{ignoreCase: true})}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	// The accented ί is a distinct letter from ι, so only the name matches.
+	assertNewContentsOfFile(t, filepath.Join(root, "sigma.txt"), "σίγμα Σίγμα", "σιγμα", "sigma", "σίγμα Σίγμα")
+}
+
+// TestWalkDir_PreserveCase ensures every case variant of find is rewritten in
+// the matching case, in names and contents, and that a mixed-case match is
+// reported rather than guessed.
+func TestWalkDir_PreserveCase(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"foo.txt":  "foo\nFoo\nFOO\n",
+		"Foo.go":   "type Foo struct{}\n",
+		"FOO.md":   "# FOO\n",
+		"mixed.go": "fOO\nfoo\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v", name, err)
+		}
+	}
+
+	logs := captureLog(t)
+	fr := findReplace{find: "foo", replace: "bar", matcher: newMatcherOrFatal(t, "foo", "bar", matchOptions{preserveCase: true})}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	assertNewContentsOfFile(t, filepath.Join(root, "bar.txt"), files["foo.txt"], "foo", "bar", "bar\nBar\nBAR\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "Bar.go"), files["Foo.go"], "foo", "bar", "type Bar struct{}\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "BAR.md"), files["FOO.md"], "foo", "bar", "# BAR\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "mixed.go"), files["mixed.go"], "foo", "bar", "fOO\nbar\n")
+
+	want := "Not replacing \"fOO\" at " + filepath.Join(root, "mixed.go") + ":1: case is ambiguous"
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("log output = %q; want it to contain %q", logs.String(), want)
+	}
+}
+
+// TestRenameFile_PreserveCaseAmbiguous ensures a mixed-case match in a file
+// name is reported and left alone.
+func TestRenameFile_PreserveCaseAmbiguous(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "fOo.txt")
+	if err := os.WriteFile(src, nil, 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", src, err)
+	}
+
+	logs := captureLog(t)
+	fr := findReplace{find: "foo", replace: "bar", matcher: newMatcherOrFatal(t, "foo", "bar", matchOptions{preserveCase: true})}
+	if err := fr.RenameFile(newFileOrFatal(t, src)); err != nil {
+		t.Fatalf("RenameFile(%q): %v", src, err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Stat(%q): %v (ambiguous name was renamed)", src, err)
+	}
+	if !strings.Contains(logs.String(), "case is ambiguous") {
+		t.Errorf("log output = %q; want the ambiguous name reported", logs.String())
+	}
+}
+
+// TestWalkDir_Identifiers ensures each identifier style of find is replaced
+// with the same style of replace in names and contents, and that the hits
+// are tallied per style.
+func TestWalkDir_Identifiers(t *testing.T) {
+	root := t.TempDir()
+	content := "userAccount := UserAccount{}\nconst USER_ACCOUNT = \"user-account\"\n"
+	if err := os.WriteFile(filepath.Join(root, "user_account.go"), []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	m, err := newIdentifierMatcher("user account", "customer profile")
+	if err != nil {
+		t.Fatalf("newIdentifierMatcher: %v", err)
+	}
+	fr := findReplace{find: "user account", replace: "customer profile", matcher: m}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	want := "customerProfile := CustomerProfile{}\nconst CUSTOMER_PROFILE = \"customer-profile\"\n"
+	assertNewContentsOfFile(t, filepath.Join(root, "customer_profile.go"), content, "user account", "customer profile", want)
+
+	wantHits := map[string]int{
+		"camelCase":            1,
+		"PascalCase":           1,
+		"snake_case":           1, // the file name
+		"SCREAMING_SNAKE_CASE": 1,
+		"kebab-case":           1,
+		"flatcase":             0,
+	}
+	for style, want := range wantHits {
+		if got := fr.styleHits.count(style); got != want {
+			t.Errorf("hits for %v = %d; want %d", style, got, want)
+		}
+	}
+}
+
+// TestRun_IdentifiersSummary confirms --identifiers prints per-style hits.
+func TestRun_IdentifiersSummary(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("user_account userAccount user_account"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--identifiers", "user account", "customer profile"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	for _, want := range []string{"  snake_case: 2\n", "  camelCase: 1\n", "  kebab-case: 0\n"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log output = %q; want it to contain %q", logs.String(), want)
+		}
+	}
+}
+
+// TestWalkDir_Word reproduces the README's nova benchmark, where replacing
+// virt with subvert should leave virtual and libvirt alone, in both names and
+// contents.
+func TestWalkDir_Word(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"virt":        "import virt\n",
+		"virtual":     "virtual\n",
+		"libvirt.py":  "from nova import virt, libvirt\n",
+		"virt_api.py": "virt_api\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v", name, err)
+		}
+	}
+
+	fr := findReplace{find: "virt", replace: "subvert", matcher: newMatcherOrFatal(t, "virt", "subvert", matchOptions{word: true})}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	assertNewContentsOfFile(t, filepath.Join(root, "subvert"), files["virt"], "virt", "subvert", "import subvert\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "virtual"), files["virtual"], "virt", "subvert", "virtual\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "libvirt.py"), files["libvirt.py"], "virt", "subvert", "from nova import subvert, libvirt\n")
+	assertNewContentsOfFile(t, filepath.Join(root, "virt_api.py"), files["virt_api.py"], "virt", "subvert", "virt_api\n")
+}
+
+// writeTree creates each of files (a map of slash-separated relative path to
+// content) beneath root.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("MkdirAll(%q): %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v", path, err)
+		}
+	}
+}
+
+// assertTree ensures that each of files (a map of slash-separated relative
+// path to content) exists beneath root with the given content.
+func assertTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, want := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("ReadFile(%q): %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("contents of %v = %q; want %q", name, got, want)
+		}
+	}
+}
+
+// TestWalkDir_IncludeExclude ensures that only included paths are rewritten
+// and renamed, and that excluded directories are left entirely alone.
+func TestWalkDir_IncludeExclude(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"alpha.go":                "alpha",
+		"alpha.md":                "alpha",
+		"pkg/alpha/alpha.go":      "alpha",
+		"vendor/alpha/alpha.go":   "alpha",
+		"pkg/testdata/alpha.go":   "alpha",
+		"pkg/alpha/alpha_test.go": "alpha",
+	})
+
+	fr := findReplace{find: "alpha", replace: "beta"}
+	for flag, value := range map[*globList][]string{
+		&fr.filter.include: {"*.go"},
+		&fr.filter.exclude: {"vendor/", "**/testdata", "*_test.go"},
+	} {
+		for _, v := range value {
+			if err := flag.Set(v); err != nil {
+				t.Fatalf("Set(%q): %v", v, err)
+			}
+		}
+	}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	assertTree(t, root, map[string]string{
+		"beta.go":                 "beta",
+		"alpha.md":                "alpha",
+		"pkg/alpha/beta.go":       "beta", // the directory does not match *.go
+		"vendor/alpha/alpha.go":   "alpha",
+		"pkg/testdata/alpha.go":   "alpha",
+		"pkg/alpha/alpha_test.go": "alpha",
+	})
+}
+
+// TestWalkDir_ExcludedDirectoryNotEntered ensures that the walker does not
+// even list an excluded directory, by making it unreadable.
+func TestWalkDir_ExcludedDirectoryNotEntered(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission semantics differ on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("test requires non-root: chmod 0 directories are still readable as root")
+	}
+
+	root := t.TempDir()
+	denied := filepath.Join(root, "denied")
+	if err := os.Mkdir(denied, 0); err != nil {
+		t.Fatalf("Mkdir(%q): %v", denied, err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(denied, 0700) })
+
+	fr := findReplace{find: "alpha", replace: "beta"}
+	if err := fr.filter.exclude.Set("denied"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Errorf("WalkDir reported errors: %v (excluded directory was entered)", err)
+	}
+}
+
+// TestRun_IncludeExcludeFlags confirms the flags are repeatable and reject
+// malformed globs.
+func TestWalkDir_RespectsIgnoreFiles(t *testing.T) {
+	isolateGitConfig(t)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".git/info/exclude":         "local.txt\n",
+		".gitignore":                "node_modules/\n*.gen\n!keep.gen\n",
+		"node_modules/pkg/index.js": "alpha",
+		"src/main.go":               "alpha",
+		"src/out.gen":               "alpha",
+		"src/keep.gen":              "alpha",
+		"src/.gitignore":            "!out.gen\n",
+		"src/.findreplaceignore":    "main.go\n",
+		"local.txt":                 "alpha",
+		"other.gen":                 "alpha",
+	})
+
+	fr := findReplace{find: "alpha", replace: "beta"}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+	assertTree(t, root, map[string]string{
+		"node_modules/pkg/index.js": "alpha",
+		"src/main.go":               "alpha",
+		"src/out.gen":               "beta",
+		"src/keep.gen":              "beta",
+		"local.txt":                 "alpha",
+		"other.gen":                 "alpha",
+	})
+}
+
+func TestRun_NoIgnoreFlag(t *testing.T) {
+	isolateGitConfig(t)
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".ignore":   "build/\n",
+		"build/out": "alpha",
+	})
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"build/out": "alpha"})
+
+	if got := run([]string{"find-replace", "--no-ignore", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run --no-ignore = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"build/out": "beta"})
+}
+
+// TestWalkDir_SingleJobDeepTree confirms a walk with a single worker neither
+// deadlocks nor renames a directory before its children.
+func TestWalkDir_SingleJobDeepTree(t *testing.T) {
+	root := t.TempDir()
+	files := make(map[string]string)
+	path := "alpha"
+	for i := 0; i < 50; i++ {
+		files[path+"/alpha.txt"] = "alpha"
+		path += "/alpha"
+	}
+	writeTree(t, root, files)
+
+	fr := findReplace{find: "alpha", replace: "beta", workers: workerPool{jobs: 1}}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+	want := make(map[string]string)
+	for name := range files {
+		want[strings.ReplaceAll(name, "alpha", "beta")] = "beta"
+	}
+	assertTree(t, root, want)
+}
+
+func TestRun_InvalidJobsIsUsageError(t *testing.T) {
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "-j", "0", "alpha", "beta"}, nil, io.Discard, &stderr); got != 1 {
+		t.Errorf("run = %d; want 1", got)
+	}
+	if !strings.Contains(stderr.String(), "--jobs must be at least 1") {
+		t.Errorf("stderr = %q; want it to explain the bad --jobs", stderr.String())
+	}
+}
+
+func TestRun_IncludeExcludeFlags(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go":   "alpha",
+		"b.txt":  "alpha",
+		"c.yaml": "alpha",
+	})
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--include", "*.go", "--include", "*.txt", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"a.go": "beta", "b.txt": "beta", "c.yaml": "alpha"})
+
+	if got := run([]string{"find-replace", "--exclude", "[a-", "alpha", "beta"}, nil, io.Discard, &stderr); got == 0 {
+		t.Errorf("run with a malformed glob = 0; want non-zero")
+	}
+}
+
+// TestRenameFile_RefusesInvalidName ensures a replacement that would produce
+// a path separator (possible with --regex) is refused rather than moving the
+// file into another directory.
+func TestRenameFile_RefusesInvalidName(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "alpha")
+	if err := os.WriteFile(src, nil, 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", src, err)
+	}
+
+	fr := findReplace{find: "alpha", replace: "a/b"}
+	if err := fr.RenameFile(newFileOrFatal(t, src)); err == nil {
+		t.Errorf("RenameFile(%q) to a name containing a separator: err = nil; want an error", src)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Stat(%q) after refused rename: %v", src, err)
+	}
+}
+
 // TestWalkDir_PermissionDeniedSubdirContinues ensures that an unreadable
 // subdirectory does not abort the walk. The sibling subtree must still be
 // rewritten, and the walker must record an error referencing the failing
@@ -535,14 +1037,14 @@ func TestWalkDir_BadRenameTargetDoesNotAbortSiblings(t *testing.T) {
 	}
 }
 
-// TestWriteCleansUpTempFileOnRenameFailure ensures that File.Write does not
-// leak a temp file when the rename step fails. It forces the rename to fail
+// TestCommitCleansUpTempFileOnRenameFailure ensures that File.Commit does
+// not leak the temp file Stage made when the rename fails. It forces the rename to fail
 // (after the temp file has been created) by making the destination a
 // non-empty directory; os.Rename of a regular file onto a non-empty
 // directory returns ENOTEMPTY ("file exists") on Linux regardless of the
 // running user, so this exercises the deferred-cleanup path under both root
 // and non-root.
-func TestWriteCleansUpTempFileOnRenameFailure(t *testing.T) {
+func TestCommitCleansUpTempFileOnRenameFailure(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("rename-over-directory semantics differ on Windows")
 	}
@@ -550,8 +1052,8 @@ func TestWriteCleansUpTempFileOnRenameFailure(t *testing.T) {
 	dir := t.TempDir()
 	target := filepath.Join(dir, "target")
 
-	// Create the target as a non-empty directory. Write will succeed in
-	// creating its tempfile next to it, then fail the rename step.
+	// Create the target as a non-empty directory. Stage will succeed in
+	// creating its tempfile next to it, then Commit will fail to rename it.
 	if err := os.Mkdir(target, 0700); err != nil {
 		t.Fatalf("Mkdir(%q): %v", target, err)
 	}
@@ -559,7 +1061,7 @@ func TestWriteCleansUpTempFileOnRenameFailure(t *testing.T) {
 		t.Fatalf("WriteFile sentinel: %v", err)
 	}
 
-	// Snapshot the directory contents before the Write so we can confirm no
+	// Snapshot the directory contents before Stage so we can confirm no
 	// stray files survive afterwards.
 	beforeEntries, err := os.ReadDir(dir)
 	if err != nil {
@@ -570,14 +1072,13 @@ func TestWriteCleansUpTempFileOnRenameFailure(t *testing.T) {
 		before[e.Name()] = struct{}{}
 	}
 
-	// We need f.Mode() to succeed, so prime the cached info.
 	f := newFileOrFatal(t, target)
-	if _, err := f.Info(); err != nil {
-		t.Fatalf("Info(%q): %v", target, err)
+	tempName, err := f.Stage("beta")
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
 	}
-
-	if err := f.Write("beta"); err == nil {
-		t.Fatalf("Write succeeded over a non-empty directory; expected an error")
+	if err := f.Commit(tempName); err == nil {
+		t.Fatalf("Commit succeeded over a non-empty directory; expected an error")
 	}
 
 	// Confirm no new entries (other than the existing target directory)
@@ -590,7 +1091,7 @@ func TestWriteCleansUpTempFileOnRenameFailure(t *testing.T) {
 		if _, ok := before[e.Name()]; ok {
 			continue
 		}
-		t.Errorf("leftover entry %q in %q after Write failure (tempfile was not cleaned up)", e.Name(), dir)
+		t.Errorf("leftover entry %q in %q after Commit failure (tempfile was not cleaned up)", e.Name(), dir)
 	}
 }
 
@@ -604,7 +1105,7 @@ func TestRun_ExitsZeroOnSuccess(t *testing.T) {
 	withWorkingDir(t, dir)
 
 	var stderr bytes.Buffer
-	got := run([]string{"find-replace", "alpha", "beta"}, &stderr)
+	got := run([]string{"find-replace", "alpha", "beta"}, nil, io.Discard, &stderr)
 	if got != 0 {
 		t.Errorf("run = %d; want 0 (stderr: %q)", got, stderr.String())
 	}
@@ -627,7 +1128,7 @@ func TestRun_ExitsNonZeroOnTraversalError(t *testing.T) {
 	withWorkingDir(t, dir)
 
 	var stderr bytes.Buffer
-	got := run([]string{"find-replace", "alpha", "beta"}, &stderr)
+	got := run([]string{"find-replace", "alpha", "beta"}, nil, io.Discard, &stderr)
 	if got == 0 {
 		t.Errorf("run = 0; want non-zero (stderr: %q)", stderr.String())
 	}
@@ -637,7 +1138,7 @@ func TestRun_ExitsNonZeroOnTraversalError(t *testing.T) {
 // and the exit code is non-zero.
 func TestRun_BadArgCountPrintsUsage(t *testing.T) {
 	var stderr bytes.Buffer
-	got := run([]string{"find-replace"}, &stderr)
+	got := run([]string{"find-replace"}, nil, io.Discard, &stderr)
 	if got == 0 {
 		t.Errorf("run = 0; want non-zero")
 	}
@@ -646,6 +1147,251 @@ func TestRun_BadArgCountPrintsUsage(t *testing.T) {
 	}
 }
 
+// TestWalkDir_DryRunLeavesTreeUntouched ensures that a dry run reports every
+// rewrite and rename, using final paths beneath renamed directories, without
+// changing any file names or contents.
+func TestWalkDir_DryRunLeavesTreeUntouched(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "alpha")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir(%q): %v", dir, err)
+	}
+	file := filepath.Join(dir, "alpha.txt")
+	if err := os.WriteFile(file, []byte("alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", file, err)
+	}
+
+	logs := captureLog(t)
+	fr := findReplace{find: "alpha", replace: "beta", dryRun: true}
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir reported errors: %v", err)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v (dry run moved or removed the file)", file, err)
+	}
+	if string(got) != "alpha" {
+		t.Errorf("contents of %v = %q after dry run; want %q", file, string(got), "alpha")
+	}
+
+	wantLines := []string{
+		"Would rewrite " + file,
+		"Would rename " + file + " to " + filepath.Join(root, "beta", "beta.txt"),
+		"Would rename " + dir + " to " + filepath.Join(root, "beta"),
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(logs.String(), want+"\n") {
+			t.Errorf("dry run output = %q; want a line %q", logs.String(), want)
+		}
+	}
+}
+
+// TestRenameFile_DryRunReportsOccupiedDestination ensures a dry run refuses
+// the same clobbering renames that a real run would.
+func TestRenameFile_DryRunReportsOccupiedDestination(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "alpha")
+	if err := os.WriteFile(src, nil, 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v", src, err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "beta"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	fr := findReplace{find: "alpha", replace: "beta", dryRun: true}
+	if err := fr.RenameFile(newFileOrFatal(t, src)); err == nil {
+		t.Errorf("RenameFile(%q) during dry run: err = nil; want a refusal", src)
+	}
+}
+
+// TestRun_DryRunFlag confirms --dry-run is accepted and leaves files alone.
+func TestRun_DryRunFlag(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alpha.txt")
+	if err := os.WriteFile(path, []byte("alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--dry-run", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Stat(%q) after dry run: %v", path, err)
+	}
+}
+
+// captureLog redirects log.Default() into a buffer for the duration of the
+// test and restores the previous output at cleanup.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+// TestRun_Regex confirms --regex rewrites contents and names using capture
+// groups.
+func TestRun_Regex(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "v1.2.txt"), []byte("v1.2"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--regex", `v(\d+)\.(\d+)`, "v${1}_$2"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "v1_2.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != "v1_2" {
+		t.Errorf("contents = %q; want %q", got, "v1_2")
+	}
+}
+
+// TestRun_IgnoreCaseShorthand confirms -i enables case-insensitive matching.
+func TestRun_IgnoreCaseShorthand(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ALPHA.txt"), []byte("Alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "-i", "alpha", "beta"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertNewContentsOfFile(t, filepath.Join(dir, "beta.txt"), "Alpha", "alpha", "beta", "beta")
+}
+
+// TestRun_EmptyFindIsUsageError confirms an empty FIND is rejected rather
+// than matching between every character.
+func TestRun_EmptyFindIsUsageError(t *testing.T) {
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "", "beta"}, nil, io.Discard, &stderr); got == 0 {
+		t.Errorf("run = 0; want non-zero")
+	}
+}
+
+// TestRun_InvalidWordCharsIsUsageError confirms an invalid --word-chars class
+// is reported before anything is walked.
+func TestRun_InvalidWordCharsIsUsageError(t *testing.T) {
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--word", "--word-chars", "[a-", "alpha", "beta"}, nil, io.Discard, &stderr); got == 0 {
+		t.Errorf("run = 0; want non-zero")
+	}
+	if !strings.Contains(stderr.String(), "invalid word character class") {
+		t.Errorf("stderr = %q; want it to explain the invalid class", stderr.String())
+	}
+}
+
+// TestRun_InvalidRegexIsUsageError confirms that an invalid pattern is
+// reported before anything is walked.
+func TestRun_InvalidRegexIsUsageError(t *testing.T) {
+	var stderr bytes.Buffer
+	got := run([]string{"find-replace", "--regex", "(alpha", "beta"}, nil, io.Discard, &stderr)
+	if got == 0 {
+		t.Errorf("run = 0; want non-zero")
+	}
+	if !strings.Contains(stderr.String(), "invalid regular expression") {
+		t.Errorf("stderr = %q; want it to explain the invalid pattern", stderr.String())
+	}
+}
+
+// TestRun_ExplicitPaths confirms that only the given directories and files
+// are processed, and that a file given directly is renamed.
+func TestRun_ExplicitPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"walked/alpha.txt", "skipped/alpha.txt", "single-alpha.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("alpha"), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v", path, err)
+		}
+	}
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "alpha", "beta", "walked", "single-alpha.txt"}, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertNewContentsOfFile(t, filepath.Join(dir, "walked", "beta.txt"), "alpha", "alpha", "beta", "beta")
+	assertNewContentsOfFile(t, filepath.Join(dir, "single-beta.txt"), "alpha", "alpha", "beta", "beta")
+	assertNewContentsOfFile(t, filepath.Join(dir, "skipped", "alpha.txt"), "alpha", "alpha", "beta", "alpha")
+	if _, err := os.Stat(filepath.Join(dir, "walked")); err != nil {
+		t.Errorf("Stat(walked): %v (a walked root should not be renamed)", err)
+	}
+}
+
+// TestRun_OverlappingPathsProcessedOnce confirms that paths repeated or
+// nested inside another path are only processed once, using a replacement
+// that would compound if applied twice.
+func TestRun_OverlappingPathsProcessedOnce(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "sub", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(nested), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(nested, []byte("a"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	// The symlink lives outside the tree so that only the explicit path
+	// argument refers to it.
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(filepath.Join(dir, "sub"), link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var stderr bytes.Buffer
+	args := []string{"find-replace", "a", "aa", "sub/file.txt", "sub", "./sub/", link, "sub/file.txt"}
+	if got := run(args, nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertNewContentsOfFile(t, nested, "a", "a", "aa", "aa")
+}
+
+// TestRun_MissingPathDoesNotStopOthers confirms that a path that does not
+// exist is reported, and the remaining paths are still processed.
+func TestRun_MissingPathDoesNotStopOthers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "alpha", "beta", "missing", "file.txt"}, nil, io.Discard, &stderr); got == 0 {
+		t.Errorf("run = 0; want non-zero for a missing path")
+	}
+	if !strings.Contains(logs.String(), "missing") {
+		t.Errorf("log output = %q; want the missing path reported", logs.String())
+	}
+	assertNewContentsOfFile(t, filepath.Join(dir, "file.txt"), "alpha", "alpha", "beta", "beta")
+}
+
 // withWorkingDir chdirs to dir for the duration of the test and restores the
 // previous working directory at cleanup.
 func withWorkingDir(t *testing.T, dir string) {
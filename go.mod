@@ -2,4 +2,8 @@ module github.com/dolph/find-replace
 
 go 1.20
 
-require golang.org/x/tools v0.7.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	golang.org/x/tools v0.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Ways of rewriting a file that has other hard links, for --hardlinks.
+const (
+	// hardlinksSplit replaces the file with a new one, as with any other
+	// file, so that its other links keep the old contents.
+	hardlinksSplit = "split"
+
+	// hardlinksInPlace writes the new contents into the existing file, so
+	// that every link sees them.
+	hardlinksInPlace = "inplace"
+
+	// hardlinksSkip leaves the file alone.
+	hardlinksSkip = "skip"
+)
+
+// hardlinked reports whether info describes a file with other hard links,
+// and if so returns a key identifying it.
+func hardlinked(info os.FileInfo) (string, bool) {
+	id, links, ok := inode(info)
+	return id, ok && links > 1
+}
+
+// claimHardlinks reports whether the contents of f should be handled, given
+// --hardlinks: a file with other hard links is skipped under skip, and under
+// inplace is only handled by way of the first of its paths the walk finds,
+// since rewriting it once rewrites every link.
+func (fr *findReplace) claimHardlinks(f *File) bool {
+	info, err := f.Info()
+	if err != nil {
+		return true
+	}
+	id, ok := hardlinked(info)
+	if !ok {
+		return true
+	}
+	switch fr.hardlinks {
+	case hardlinksSkip:
+		fr.reporter().skipped(f.Path, skipHardlink)
+		return false
+	case hardlinksInPlace:
+		return fr.inodes.claim(id)
+	}
+	return true
+}
+
+// writesInPlace reports whether the rewrite of f should be written into the
+// existing file rather than replace it.
+func (fr *findReplace) writesInPlace(f *File) bool {
+	if fr.hardlinks != hardlinksInPlace {
+		return false
+	}
+	info, err := f.Info()
+	if err != nil {
+		return false
+	}
+	_, ok := hardlinked(info)
+	return ok
+}
+
+// CommitInPlace copies the staged temp file tempName into the file, keeping
+// it the same file, so that every hard link to it sees the new contents, and
+// then removes tempName. Unlike Commit this is not atomic: the file can be
+// seen part way through being copied.
+func (f *File) CommitInPlace(tempName string) error {
+	defer os.Remove(tempName)
+	return copyContents(tempName, f.Path, os.O_WRONLY|os.O_TRUNC)
+}
+
+// copyContents copies the contents of src into dst, opened with flag (and,
+// if flag creates it, mode 0600), along with its access and modification
+// times.
+func copyContents(src string, dst string, flag int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("copy %v to %v: %w", src, dst, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("copy %v to %v: %w", src, dst, err)
+	}
+	out, err := os.OpenFile(dst, flag, 0600)
+	if err != nil {
+		return fmt.Errorf("copy %v to %v: %w", src, dst, err)
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, accessTime(info), info.ModTime())
+	}
+	if err != nil {
+		return fmt.Errorf("copy %v to %v: %w", src, dst, err)
+	}
+	return nil
+}
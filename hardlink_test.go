@@ -0,0 +1,91 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeHardlinks writes content to a.txt in a new directory, hard links it
+// as b.txt, and returns the directory.
+func writeHardlinks(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": content})
+	if err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	return dir
+}
+
+// assertLinked fails the test unless a.txt and b.txt in dir are (or are not)
+// the same file.
+func assertLinked(t *testing.T, dir string, want bool) {
+	t.Helper()
+	a, errA := os.Stat(filepath.Join(dir, "a.txt"))
+	b, errB := os.Stat(filepath.Join(dir, "b.txt"))
+	if errA != nil || errB != nil {
+		t.Fatalf("Stat: %v, %v", errA, errB)
+	}
+	if got := os.SameFile(a, b); got != want {
+		t.Errorf("a.txt and b.txt are the same file: %v; want %v", got, want)
+	}
+}
+
+func TestRun_HardlinksSplit(t *testing.T) {
+	dir := writeHardlinks(t, "z")
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "z", "zz", "a.txt")
+	assertTree(t, dir, map[string]string{"a.txt": "zz", "b.txt": "z"})
+	assertLinked(t, dir, false)
+}
+
+// TestRun_HardlinksInPlace confirms that every link sees the new contents,
+// and that the file is rewritten only once, using a replacement that would
+// compound if applied twice.
+func TestRun_HardlinksInPlace(t *testing.T) {
+	for name, args := range map[string][]string{
+		"in memory": {"--stream-threshold", "0"},
+		"streamed":  {"--stream-threshold", "1"},
+		"atomic":    {"--atomic"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("XDG_STATE_HOME", t.TempDir())
+			dir := writeHardlinks(t, "z")
+			withWorkingDir(t, dir)
+			captureLog(t)
+
+			runOrFatal(t, append([]string{"--hardlinks=inplace"}, append(args, "z", "zz")...)...)
+			assertTree(t, dir, map[string]string{"a.txt": "zz", "b.txt": "zz"})
+			assertLinked(t, dir, true)
+
+			runOrFatal(t, "undo")
+			assertTree(t, dir, map[string]string{"a.txt": "z", "b.txt": "z"})
+			assertLinked(t, dir, true)
+		})
+	}
+}
+
+func TestRun_HardlinksSkip(t *testing.T) {
+	dir := writeHardlinks(t, "alpha")
+	writeTree(t, dir, map[string]string{"c.txt": "alpha"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--hardlinks=skip", "alpha", "beta")
+	assertTree(t, dir, map[string]string{"a.txt": "alpha", "b.txt": "alpha", "c.txt": "beta"})
+	assertLinked(t, dir, true)
+}
+
+func TestRun_HardlinksRejectsUnknownMode(t *testing.T) {
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--hardlinks=copy", "alpha", "beta"}, nil, io.Discard, &stderr); got != 1 {
+		t.Errorf("run --hardlinks=copy = %d; want 1", got)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inode returns a key identifying the file described by info, by its device
+// and inode numbers, and how many hard links it has.
+func inode(info os.FileInfo) (string, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), uint64(stat.Nlink), true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// identifierStyle is a naming convention for joining a list of lowercase
+// words into a single identifier.
+type identifierStyle struct {
+	name string
+	join func(words []string) string
+}
+
+// identifierStyles lists the conventions --identifiers expands FIND and
+// REPLACE into. When two styles spell the same identifier (as they do for a
+// single word), the earlier style claims it.
+var identifierStyles = []identifierStyle{
+	{"camelCase", func(words []string) string {
+		return words[0] + joinTitled(words[1:], "")
+	}},
+	{"PascalCase", func(words []string) string {
+		return joinTitled(words, "")
+	}},
+	{"snake_case", func(words []string) string {
+		return strings.Join(words, "_")
+	}},
+	{"SCREAMING_SNAKE_CASE", func(words []string) string {
+		return strings.ToUpper(strings.Join(words, "_"))
+	}},
+	{"kebab-case", func(words []string) string {
+		return strings.Join(words, "-")
+	}},
+	{"flatcase", func(words []string) string {
+		return strings.Join(words, "")
+	}},
+}
+
+// joinTitled joins words with sep, upper-casing the first letter of each.
+func joinTitled(words []string, sep string) string {
+	titled := make([]string, len(words))
+	for i, word := range words {
+		titled[i] = upperFirst(word)
+	}
+	return strings.Join(titled, sep)
+}
+
+// splitWords splits s into lowercase words, breaking on whitespace,
+// underscores, hyphens, and lower-to-upper case transitions, so that "user
+// account", "user_account" and "userAccount" all give [user account].
+func splitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, strings.ToLower(word.String()))
+			word.Reset()
+		}
+	}
+
+	prev := rune(-1)
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r) || r == '_' || r == '-':
+			flush()
+		case unicode.IsUpper(r) && prev >= 0 && unicode.IsLower(prev):
+			flush()
+			word.WriteRune(r)
+		default:
+			word.WriteRune(r)
+		}
+		prev = r
+	}
+	flush()
+	return words
+}
+
+// newIdentifierMatcher returns a matcher that maps each identifier style of
+// the words in find to the same style of the words in replace.
+func newIdentifierMatcher(find string, replace string) (matcher, error) {
+	findWords, replaceWords := splitWords(find), splitWords(replace)
+	if len(findWords) == 0 {
+		return nil, errors.New("--identifiers needs at least one word in FIND")
+	}
+	if len(replaceWords) == 0 {
+		return nil, errors.New("--identifiers needs at least one word in REPLACE")
+	}
+
+	var pairs []literalPair
+	seen := make(map[string]bool)
+	for _, style := range identifierStyles {
+		pattern := style.join(findWords)
+		if seen[pattern] {
+			continue
+		}
+		seen[pattern] = true
+		pairs = append(pairs, literalPair{find: pattern, replace: style.join(replaceWords), style: style.name})
+	}
+	return newMultiLiteralMatcher(pairs), nil
+}
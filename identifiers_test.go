@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	tests := map[string][]string{
+		"user account":  {"user", "account"},
+		"user_account":  {"user", "account"},
+		"user-account":  {"user", "account"},
+		"userAccount":   {"user", "account"},
+		"UserAccount":   {"user", "account"},
+		"USER ACCOUNT":  {"user", "account"},
+		"  user  ":      {"user"},
+		"html parser 2": {"html", "parser", "2"},
+		"":              nil,
+	}
+	for input, want := range tests {
+		if got := splitWords(input); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitWords(%q) = %q; want %q", input, got, want)
+		}
+	}
+}
+
+func TestIdentifierMatcher(t *testing.T) {
+	m, err := newIdentifierMatcher("user account", "customer profile")
+	if err != nil {
+		t.Fatalf("newIdentifierMatcher: %v", err)
+	}
+	assertReplaced(t, m,
+		"userAccount UserAccount user_account USER_ACCOUNT user-account useraccount",
+		"customerProfile CustomerProfile customer_profile CUSTOMER_PROFILE customer-profile customerprofile")
+}
+
+func TestIdentifierMatcherStyles(t *testing.T) {
+	m, err := newIdentifierMatcher("user account", "customer profile")
+	if err != nil {
+		t.Fatalf("newIdentifierMatcher: %v", err)
+	}
+	var got []string
+	for _, match := range m.findAll("getUserAccount(user_account)") {
+		got = append(got, match.style)
+	}
+	if want := []string{"PascalCase", "snake_case"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("styles = %q; want %q", got, want)
+	}
+}
+
+func TestIdentifierMatcherSingleWord(t *testing.T) {
+	m, err := newIdentifierMatcher("user", "member")
+	if err != nil {
+		t.Fatalf("newIdentifierMatcher: %v", err)
+	}
+	assertReplaced(t, m, "user User USER", "member Member MEMBER")
+}
+
+func TestIdentifierMatcherNeedsWords(t *testing.T) {
+	if _, err := newIdentifierMatcher("--", "beta"); err == nil {
+		t.Errorf("newIdentifierMatcher with no words in FIND: err = nil; want an error")
+	}
+	if _, err := newIdentifierMatcher("alpha", " "); err == nil {
+		t.Errorf("newIdentifierMatcher with no words in REPLACE: err = nil; want an error")
+	}
+}
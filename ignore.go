@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileNames lists the per-directory ignore files the walker reads, in
+// order of precedence: .findreplaceignore overrides .ignore, which overrides
+// .gitignore.
+var ignoreFileNames = []string{".findreplaceignore", ".ignore", ".gitignore"}
+
+// ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	glob   globPattern
+	negate bool
+}
+
+// ignoreFile holds the rules parsed from a single ignore file, whose patterns
+// are relative to dir.
+type ignoreFile struct {
+	path  string
+	dir   string
+	rules []ignoreRule
+}
+
+// match reports whether the absolute path is ignored by the last rule in
+// the file that matches it, and whether any rule matched at all.
+func (f *ignoreFile) match(path string, isDir bool) (ignored bool, matched bool) {
+	rel, err := filepath.Rel(f.dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false, false
+	}
+	rel = filepath.ToSlash(rel)
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if f.rules[i].glob.match(rel, isDir) {
+			return !f.rules[i].negate, true
+		}
+	}
+	return false, false
+}
+
+// parseIgnoreRules parses content using .gitignore syntax: blank lines and
+// lines starting with # are skipped, a leading ! negates a pattern, trailing
+// spaces are trimmed unless escaped with a backslash, and a backslash escapes
+// a leading # or !. Malformed patterns are skipped, as git does.
+func parseIgnoreRules(content string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		line = trimUnescapedTrailingSpaces(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		glob, err := compileGlob(line)
+		if err != nil {
+			continue
+		}
+		rule.glob = glob
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// trimUnescapedTrailingSpaces removes trailing spaces from line, stopping at
+// a space escaped with a backslash.
+func trimUnescapedTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		if end >= 2 && line[end-2] == '\\' {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// loadIgnoreFile reads and parses the ignore file at path, whose patterns are
+// relative to dir. It returns nil, without an error, if the file does not
+// exist.
+func loadIgnoreFile(path string, dir string) (*ignoreFile, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read ignore file %v: %w", path, err)
+	}
+	return &ignoreFile{path: path, dir: dir, rules: parseIgnoreRules(string(content))}, nil
+}
+
+// loadDirIgnores loads the ignore files that sit in dir, in order of
+// precedence.
+func loadDirIgnores(dir string) ([]*ignoreFile, error) {
+	var files []*ignoreFile
+	var errs []error
+	for _, name := range ignoreFileNames {
+		f, err := loadIgnoreFile(filepath.Join(dir, name), dir)
+		if err != nil {
+			errs = append(errs, err)
+		} else if f != nil {
+			files = append(files, f)
+		}
+	}
+	return files, errors.Join(errs...)
+}
+
+// loadRootIgnores loads every ignore file that applies to the walk rooted at
+// dir, in order of precedence: the ignore files in dir itself and in each
+// directory above it up to the top of its git work tree, then the
+// repository's .git/info/exclude, then the global excludes file named by
+// git's core.excludesFile. The last two only apply inside a git work tree.
+func loadRootIgnores(dir string) ([]*ignoreFile, error) {
+	files, err := loadDirIgnores(dir)
+	errs := []error{err}
+
+	top, gitDir := findGitDir(dir)
+	if top == "" {
+		return files, errors.Join(errs...)
+	}
+	for ancestor := dir; ancestor != top; {
+		ancestor = filepath.Dir(ancestor)
+		more, err := loadDirIgnores(ancestor)
+		files = append(files, more...)
+		errs = append(errs, err)
+	}
+
+	for _, path := range []string{filepath.Join(gitDir, "info", "exclude"), globalExcludesFile(gitDir)} {
+		if path == "" {
+			continue
+		}
+		f, err := loadIgnoreFile(path, top)
+		if err != nil {
+			errs = append(errs, err)
+		} else if f != nil {
+			files = append(files, f)
+		}
+	}
+	return files, errors.Join(errs...)
+}
+
+// findGitDir returns the top of the git work tree containing dir, and its git
+// directory, or empty strings if dir is not inside a work tree. A .git file
+// (as used by worktrees and submodules) is followed to the directory it
+// points at.
+func findGitDir(dir string) (top string, gitDir string) {
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return dir, dotGit
+			}
+			if content, err := os.ReadFile(dotGit); err == nil {
+				target, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir: ")
+				if ok {
+					if !filepath.IsAbs(target) {
+						target = filepath.Join(dir, target)
+					}
+					return dir, target
+				}
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// globalExcludesFile returns the path of the global excludes file: the value
+// of core.excludesFile from the system, user and repository git config (later
+// files taking precedence), or git's default of $XDG_CONFIG_HOME/git/ignore.
+func globalExcludesFile(gitDir string) string {
+	home, _ := os.UserHomeDir()
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+
+	configs := []string{"/etc/gitconfig"}
+	if xdg != "" {
+		configs = append(configs, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		configs = append(configs, filepath.Join(home, ".gitconfig"))
+	}
+	configs = append(configs, filepath.Join(gitDir, "config"))
+
+	path := ""
+	for _, config := range configs {
+		if value, ok := gitConfigValue(config, "core", "excludesfile"); ok {
+			path = value
+		}
+	}
+	if path == "" {
+		if xdg == "" {
+			return ""
+		}
+		return filepath.Join(xdg, "git", "ignore")
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok && home != "" {
+		path = filepath.Join(home, rest)
+	}
+	return path
+}
+
+// gitConfigValue returns the last value of section.key in the git config
+// file at path. Section and key names are compared case-insensitively. Only
+// the subset of the format needed for simple settings is understood:
+// subsections, includes and multi-line values are not.
+func gitConfigValue(path string, section string, key string) (string, bool) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer handle.Close()
+
+	value, found := "", false
+	current := ""
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			current = strings.ToLower(strings.TrimSpace(name))
+			continue
+		}
+		if current != section {
+			continue
+		}
+		name, rest, _ := strings.Cut(line, "=")
+		if strings.ToLower(strings.TrimSpace(name)) != key {
+			continue
+		}
+		value, found = parseGitConfigValue(rest), true
+	}
+	return value, found
+}
+
+// parseGitConfigValue unquotes a git config value and strips any trailing
+// comment.
+func parseGitConfigValue(raw string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(raw[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(b.String())
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreFileMatch(t *testing.T) {
+	f := ignoreFile{dir: "/repo", rules: parseIgnoreRules(`# build output
+*.log
+!keep.log
+build/
+/generated
+docs/*.html
+\#literal
+\!bang
+trailing\ 
+`)}
+	tests := []struct {
+		path        string
+		isDir       bool
+		wantIgnored bool
+		wantMatched bool
+	}{
+		{"/repo/debug.log", false, true, true},
+		{"/repo/sub/debug.log", false, true, true},
+		{"/repo/keep.log", false, false, true},
+		{"/repo/build", true, true, true},
+		{"/repo/build", false, false, false},
+		{"/repo/generated", false, true, true},
+		{"/repo/sub/generated", false, false, false},
+		{"/repo/docs/index.html", false, true, true},
+		{"/repo/docs/api/index.html", false, false, false},
+		{"/repo/#literal", false, true, true},
+		{"/repo/!bang", false, true, true},
+		{"/repo/trailing ", false, true, true},
+		{"/repo/main.go", false, false, false},
+		{"/elsewhere/debug.log", false, false, false},
+	}
+	for _, tc := range tests {
+		ignored, matched := f.match(tc.path, tc.isDir)
+		if ignored != tc.wantIgnored || matched != tc.wantMatched {
+			t.Errorf("match(%q, isDir=%v) = %v, %v; want %v, %v", tc.path, tc.isDir, ignored, matched, tc.wantIgnored, tc.wantMatched)
+		}
+	}
+}
+
+func TestGitConfigValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	config := `[user]
+	excludesFile = /not/core
+[Core]
+	ExcludesFile = "/first" ; comment
+	excludesfile = /second # comment
+[alias]
+	excludesfile = /not/core/either
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, ok := gitConfigValue(path, "core", "excludesfile"); !ok || got != "/second" {
+		t.Errorf("gitConfigValue = %q, %v; want %q, true", got, ok, "/second")
+	}
+	if _, ok := gitConfigValue(path, "core", "editor"); ok {
+		t.Errorf("gitConfigValue found a key that isn't set")
+	}
+}
+
+// isolateGitConfig points the user's git configuration at an empty
+// directory, so that a developer's own global excludes don't affect tests.
+func isolateGitConfig(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	return home
+}
+
+func TestLoadRootIgnoresPrecedence(t *testing.T) {
+	home := isolateGitConfig(t)
+	repo := t.TempDir()
+	writeTree(t, home, map[string]string{".config/git/ignore": "*.global\n"})
+	writeTree(t, repo, map[string]string{
+		".git/info/exclude":       "*.exclude\n",
+		".gitignore":              "*.top\n!*.sub\n",
+		"sub/.gitignore":          "*.sub\n",
+		"sub/.ignore":             "!*.tmp\n",
+		"sub/.findreplaceignore":  "*.tmp\n",
+		"sub/dir/file.txt":        "",
+		"sub/dir/.gitignore":      "",
+		"sub/dir/.ignore":         "",
+		"sub/dir/nested/file.txt": "",
+	})
+
+	root := newFileOrFatal(t, filepath.Join(repo, "sub"))
+	var err error
+	if root.ignores, err = loadRootIgnores(root.Path); err != nil {
+		t.Fatalf("loadRootIgnores: %v", err)
+	}
+
+	fr := findReplace{}
+	for name, want := range map[string]bool{
+		"a.global":  true,
+		"a.exclude": true,
+		"a.top":     true,
+		"a.sub":     true,
+		"a.tmp":     true,
+		"a.txt":     false,
+	} {
+		if got := fr.ignored(root.child(name), false); got != want {
+			t.Errorf("ignored(%v) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestFindGitDirFollowsGitFile(t *testing.T) {
+	worktree := t.TempDir()
+	gitDir := filepath.Join(t.TempDir(), "worktrees", "wt")
+	writeTree(t, worktree, map[string]string{
+		".git":      "gitdir: " + gitDir + "\n",
+		"a/b/c.txt": "",
+	})
+
+	top, got := findGitDir(filepath.Join(worktree, "a", "b"))
+	if top != worktree || got != gitDir {
+		t.Errorf("findGitDir = %q, %q; want %q, %q", top, got, worktree, gitDir)
+	}
+}
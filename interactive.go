@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// promptContext is how many lines around each match --interactive shows.
+const promptContext = 2
+
+// promptHelp explains each answer a prompt accepts.
+var promptHelp = map[byte]string{
+	'y': "yes, replace this",
+	'n': "no, leave this alone",
+	'a': "replace this and every remaining match in this file",
+	'q': "quit: leave this and everything after it alone",
+}
+
+// prompter asks the operator to approve each replacement and rename in
+// --interactive mode. Once the operator quits, every later change is
+// declined without asking. It is safe for concurrent use, though the walk
+// should run one file at a time so that prompts come in a sensible order.
+type prompter struct {
+	mu   sync.Mutex
+	in   *bufio.Reader
+	out  io.Writer
+	quit bool
+}
+
+// newPrompter returns a prompter that reads answers from in and writes
+// prompts to out.
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// ask writes question and reads answers until one of choices is given. Any
+// other answer prints help and asks again. The end of input counts as 'q'.
+func (p *prompter) ask(question string, choices string) byte {
+	options := strings.Join(strings.Split(choices, ""), ",")
+	for {
+		fmt.Fprintf(p.out, "%v [%v,?] ", question, options)
+		line, err := p.in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if len(answer) == 1 && strings.Contains(choices, answer) {
+			return answer[0]
+		}
+		if err != nil {
+			fmt.Fprintln(p.out)
+			return 'q'
+		}
+		for i := 0; i < len(choices); i++ {
+			fmt.Fprintf(p.out, "%c - %v\n", choices[i], promptHelp[choices[i]])
+		}
+	}
+}
+
+// approveMatches shows each match in content, the contents of path, and
+// returns the ones the operator accepts. Matches that would not change
+// anything are dropped without asking.
+func (p *prompter) approveMatches(path string, content string, matches []match) []match {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var accepted []match
+	all := false
+	for _, m := range matches {
+		if m.ambiguous || m.replacement == content[m.start:m.end] {
+			continue
+		}
+		if p.quit {
+			break
+		}
+		if all {
+			accepted = append(accepted, m)
+			continue
+		}
+		p.showMatch(path, content, m)
+		switch p.ask("Replace this match?", "ynaq") {
+		case 'y':
+			accepted = append(accepted, m)
+		case 'a':
+			all = true
+			accepted = append(accepted, m)
+		case 'q':
+			p.quit = true
+		}
+	}
+	return accepted
+}
+
+// showMatch prints m, a match in content, as a diff of the lines it touches
+// with promptContext lines of context on either side.
+func (p *prompter) showMatch(path string, content string, m match) {
+	lineStart := strings.LastIndex(content[:m.start], "\n") + 1
+	lineEnd := len(content)
+	if i := strings.Index(content[m.end:], "\n"); i >= 0 {
+		lineEnd = m.end + i
+	}
+
+	before := strings.Split(content[:lineStart], "\n")
+	before = before[:len(before)-1]
+	if len(before) > promptContext {
+		before = before[len(before)-promptContext:]
+	}
+	// The lines after the match's, if anything follows its newline.
+	var after []string
+	if lineEnd+1 < len(content) {
+		after = strings.Split(strings.TrimSuffix(content[lineEnd+1:], "\n"), "\n")
+		if len(after) > promptContext {
+			after = after[:promptContext]
+		}
+	}
+
+	line := strings.Count(content[:m.start], "\n") + 1
+	fmt.Fprintf(p.out, "%v:%d:\n", path, line)
+	for _, text := range before {
+		fmt.Fprintf(p.out, " %v\n", text)
+	}
+	for _, text := range strings.Split(content[lineStart:lineEnd], "\n") {
+		fmt.Fprintf(p.out, "-%v\n", text)
+	}
+	replaced := content[lineStart:m.start] + m.replacement + content[m.end:lineEnd]
+	for _, text := range strings.Split(replaced, "\n") {
+		fmt.Fprintf(p.out, "+%v\n", text)
+	}
+	for _, text := range after {
+		fmt.Fprintf(p.out, " %v\n", text)
+	}
+}
+
+// approveRename asks whether oldPath should be renamed to newPath.
+func (p *prompter) approveRename(oldPath string, newPath string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit {
+		return false
+	}
+	switch p.ask(fmt.Sprintf("Rename %v to %v?", oldPath, newPath), "ynq") {
+	case 'y':
+		return true
+	case 'q':
+		p.quit = true
+	}
+	return false
+}
+
+// approveRelink asks whether the symlink at path should be pointed from
+// target to newTarget.
+func (p *prompter) approveRelink(path string, target string, newTarget string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit {
+		return false
+	}
+	switch p.ask(fmt.Sprintf("Point symlink %v from %v to %v?", path, target, newTarget), "ynq") {
+	case 'y':
+		return true
+	case 'q':
+		p.quit = true
+	}
+	return false
+}
+
+// approveRename reports whether f may be renamed to newPath, asking the
+// operator in --interactive mode. The answer is remembered, so that a
+// directory can be asked about before its children are visited (to work out
+// their final paths) without being asked again when it is renamed.
+func (fr *findReplace) approveRename(f *File, newPath string) bool {
+	if fr.prompt == nil {
+		return true
+	}
+	if !f.asked {
+		f.approved = fr.prompt.approveRename(f.Path, newPath)
+		f.asked = true
+	}
+	return f.approved
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newScriptedFindReplace returns a findReplace for alpha -> beta that
+// answers its --interactive prompts from answers, and the buffer the
+// prompts are written to.
+func newScriptedFindReplace(answers string) (*findReplace, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &findReplace{
+		find:    "alpha",
+		replace: "beta",
+		prompt:  newPrompter(strings.NewReader(answers), &out),
+		workers: workerPool{jobs: 1},
+	}, &out
+}
+
+func TestReplaceContents_InteractiveAnswers(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"file": "alpha 1\nalpha 2\nalpha 3\nalpha 4\n"})
+	captureLog(t)
+
+	fr, out := newScriptedFindReplace("y\nn\na\n")
+	if err := fr.ReplaceContents(newFileOrFatal(t, filepath.Join(dir, "file"))); err != nil {
+		t.Fatalf("ReplaceContents: %v", err)
+	}
+	assertTree(t, dir, map[string]string{"file": "beta 1\nalpha 2\nbeta 3\nbeta 4\n"})
+
+	want := filepath.Join(dir, "file") + ":2:\n alpha 1\n-alpha 2\n+beta 2\n alpha 3\n alpha 4\nReplace this match? [y,n,a,q,?] "
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("prompts =\n%s\nwant them to contain\n%s", out.String(), want)
+	}
+	if got := strings.Count(out.String(), "Replace this match?"); got != 3 {
+		t.Errorf("asked %d times; want 3 (the last answer covers the rest of the file)", got)
+	}
+}
+
+func TestWalkDir_InteractiveRenameAndQuit(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a-alpha.txt": "alpha",
+		"b.txt":       "alpha alpha",
+		"c-alpha.txt": "alpha",
+	})
+	captureLog(t)
+
+	// Decline a-alpha.txt's contents but rename it, then take the first
+	// match in b.txt and quit.
+	fr, out := newScriptedFindReplace("n\ny\nmaybe\ny\nq\n")
+	fr.WalkDir(newFileOrFatal(t, root))
+	if err := fr.errs.err(); err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	assertTree(t, root, map[string]string{
+		"a-beta.txt":  "alpha",
+		"b.txt":       "beta alpha",
+		"c-alpha.txt": "alpha",
+	})
+	if !strings.Contains(out.String(), "a - replace this and every remaining match in this file") {
+		t.Errorf("prompts =\n%s\nwant help after an unknown answer", out.String())
+	}
+}
+
+func TestRun_Interactive(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha.txt": "alpha 1\nalpha 2\n"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	// Take the first match, decline the second, then rename the file.
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--interactive", "alpha", "beta"}, strings.NewReader("y\nn\ny\n"), io.Discard, &stderr); got != 0 {
+		t.Fatalf("run --interactive = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"beta.txt": "beta 1\nalpha 2\n"})
+	if got := strings.Count(stderr.String(), "Replace this match?"); got != 2 {
+		t.Errorf("asked about %d matches; want 2 (prompts: %q)", got, stderr.String())
+	}
+	if want := "Rename " + filepath.Join(dir, "alpha.txt"); !strings.Contains(stderr.String(), want) {
+		t.Errorf("prompts = %q; want them to contain %q", stderr.String(), want)
+	}
+}
+
+// TestRun_InteractiveDiff confirms that the patch of a file whose rename is
+// declined doesn't say it is renamed.
+func TestRun_InteractiveDiff(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha.txt": "alpha\n"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	var patch, stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--interactive", "--diff", "alpha", "beta"}, strings.NewReader("y\nn\n"), &patch, &stderr); got != 0 {
+		t.Fatalf("run --interactive --diff = %d; want 0 (stderr: %q)", got, stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"alpha.txt": "beta\n"})
+	if strings.Contains(patch.String(), "rename") || !strings.Contains(patch.String(), "+++ b/alpha.txt") {
+		t.Errorf("patch =\n%s\nwant alpha.txt changed in place", patch.String())
+	}
+}
+
+func TestPrompterEndOfInputQuits(t *testing.T) {
+	p := newPrompter(strings.NewReader(""), &bytes.Buffer{})
+	if p.approveRename("alpha", "beta") {
+		t.Errorf("approveRename with no input = true; want false")
+	}
+	if !p.quit {
+		t.Errorf("prompter did not quit at the end of its input")
+	}
+}
+
+func TestShowMatchOnLastLine(t *testing.T) {
+	var out bytes.Buffer
+	p := newPrompter(strings.NewReader(""), &out)
+	p.showMatch("f", "first\nalpha\n", match{start: 6, end: 11, replacement: "beta"})
+	if want := "f:2:\n first\n-alpha\n+beta\n"; out.String() != want {
+		t.Errorf("showMatch printed %q; want %q", out.String(), want)
+	}
+}
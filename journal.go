@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// journalEntry records a single change made by a run, in enough detail to
+// reverse it.
+type journalEntry struct {
+	// Op is "rewrite", "rename" or "relink".
+	Op string `json:"op"`
+
+	// Path is the file that was rewritten, the old path of a rename, or
+	// the symlink that was pointed somewhere else.
+	Path string `json:"path"`
+
+	// NewPath is the new path of a rename.
+	NewPath string `json:"new_path,omitempty"`
+
+	// Target and NewTarget are where a relinked symlink pointed before and
+	// after the run.
+	Target    string `json:"target,omitempty"`
+	NewTarget string `json:"new_target,omitempty"`
+
+	// Before and After are the SHA-256 checksums of a rewritten file's
+	// contents before and after the rewrite. The original contents are
+	// stored in the run's blob directory under the name Before.
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// journal records the changes made by a single run under a directory of its
+// own within the state directory, so that `find-replace undo` can reverse
+// them. It is safe for concurrent use.
+type journal struct {
+	dir string
+
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+}
+
+// defaultStateDir returns the directory journals are kept in when
+// --state-dir is not given: $XDG_STATE_HOME/find-replace, or
+// ~/.local/state/find-replace.
+func defaultStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "find-replace"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("find state directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "find-replace"), nil
+}
+
+// openJournal starts a new journal for a run in stateDir. Runs are named by
+// the time they started, so that they sort in order.
+func openJournal(stateDir string) (*journal, error) {
+	id := time.Now().UTC().Format("20060102T150405.000000000Z")
+	dir := filepath.Join(stateDir, "runs", id)
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0700); err != nil {
+		return nil, fmt.Errorf("create journal %v: %w", dir, err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "journal.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create journal %v: %w", dir, err)
+	}
+	return &journal{dir: dir, file: file}, nil
+}
+
+// record appends e to the journal.
+func (j *journal) record(e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write journal %v: %w", j.dir, err)
+	}
+	j.entries++
+	return nil
+}
+
+// renamed records that oldPath was renamed to newPath.
+func (j *journal) renamed(oldPath string, newPath string) error {
+	return j.record(journalEntry{Op: "rename", Path: oldPath, NewPath: newPath})
+}
+
+// rewrote records that path was rewritten from the contents saved as the
+// blob before, to contents with the checksum after.
+func (j *journal) rewrote(path string, before string, after string) error {
+	return j.record(journalEntry{Op: "rewrite", Path: path, Before: before, After: after})
+}
+
+// relinked records that the symlink at path was pointed from target to
+// newTarget.
+func (j *journal) relinked(path string, target string, newTarget string) error {
+	return j.record(journalEntry{Op: "relink", Path: path, Target: target, NewTarget: newTarget})
+}
+
+// keptRuns is how many journals are kept in a state directory. Once a run
+// records a new one, the oldest beyond this many are removed, along with
+// their copies of the files they rewrote.
+const keptRuns = 10
+
+// close closes the journal, removing it altogether if nothing was recorded,
+// and otherwise removing all but the latest keptRuns journals.
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.file.Close()
+	if j.entries == 0 {
+		return os.RemoveAll(j.dir)
+	}
+	if err != nil {
+		return err
+	}
+	return pruneRuns(filepath.Dir(j.dir), keptRuns)
+}
+
+// pruneRuns removes all but the latest keep journals in the directory runs.
+func pruneRuns(runs string, keep int) error {
+	entries, err := os.ReadDir(runs)
+	if err != nil {
+		return fmt.Errorf("read journals: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+	for i := keep; i < len(entries); i++ {
+		if err := os.RemoveAll(filepath.Join(runs, entries[i].Name())); err != nil {
+			return fmt.Errorf("remove old journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// blobWriter saves a copy of a file's original contents in a journal as they
+// are written to it, and names the copy after its checksum once committed.
+type blobWriter struct {
+	j    *journal
+	temp *os.File
+	w    *bufio.Writer
+	hash hash.Hash
+}
+
+// newBlob starts a new blob in j.
+func (j *journal) newBlob() (*blobWriter, error) {
+	temp, err := os.CreateTemp(filepath.Join(j.dir, "blobs"), "partial-")
+	if err != nil {
+		return nil, fmt.Errorf("save original contents: %w", err)
+	}
+	b := &blobWriter{j: j, temp: temp, hash: sha256.New()}
+	b.w = bufio.NewWriter(io.MultiWriter(temp, b.hash))
+	return b, nil
+}
+
+func (b *blobWriter) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// commit finishes the blob and returns its checksum.
+func (b *blobWriter) commit() (string, error) {
+	err := b.w.Flush()
+	if closeErr := b.temp.Close(); err == nil {
+		err = closeErr
+	}
+	sum := hex.EncodeToString(b.hash.Sum(nil))
+	if err == nil {
+		err = os.Rename(b.temp.Name(), filepath.Join(b.j.dir, "blobs", sum))
+	}
+	if err != nil {
+		os.Remove(b.temp.Name())
+		return "", fmt.Errorf("save original contents: %w", err)
+	}
+	return sum, nil
+}
+
+// abort discards the blob.
+func (b *blobWriter) abort() {
+	b.temp.Close()
+	os.Remove(b.temp.Name())
+}
+
+// saveBlob saves content in j and returns its checksum.
+func (j *journal) saveBlob(content string) (string, error) {
+	b, err := j.newBlob()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(b, content); err != nil {
+		b.abort()
+		return "", fmt.Errorf("save original contents: %w", err)
+	}
+	return b.commit()
+}
+
+// checksum returns the hex SHA-256 checksum of s.
+func checksum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumFile returns the hex SHA-256 checksum of the file at path.
+func checksumFile(path string) (string, error) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, handle); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runUndo implements `find-replace undo`, which reverses the most recent run
+// that has not already been undone.
+func runUndo(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("find-replace undo", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: find-replace undo [flags]")
+		flags.PrintDefaults()
+	}
+	force := flags.Bool("force", false, "restore files even if they have changed since the run")
+	stateDir := flags.String("state-dir", "", "`directory` journals are kept in (default $XDG_STATE_HOME/find-replace)")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 1
+	}
+
+	if *stateDir == "" {
+		dir, err := defaultStateDir()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		*stateDir = dir
+	}
+	run, err := latestRun(*stateDir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	rep := textReporter{}
+	rep.noted(fmt.Sprintf("Undoing run %v", filepath.Base(run)))
+	if err := undoRun(run, *force, rep); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// latestRun returns the directory of the most recent run in stateDir that
+// has not been undone.
+func latestRun(stateDir string) (string, error) {
+	runs, err := os.ReadDir(filepath.Join(stateDir, "runs"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("read journals: %w", err)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Name() > runs[j].Name() })
+	for _, run := range runs {
+		dir := filepath.Join(stateDir, "runs", run.Name())
+		if _, err := os.Stat(filepath.Join(dir, "undone")); errors.Is(err, os.ErrNotExist) {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("nothing to undo in %v", stateDir)
+}
+
+// undoRun reverses every change in the journal in dir, latest first. Steps
+// that have already been reversed (by an earlier, interrupted undo) are
+// skipped. A file that has changed since the run is not restored unless
+// force is set. Each step, and each failure, is reported to rep. Failures do
+// not stop the remaining steps; if there are none, the run is marked as
+// undone.
+func undoRun(dir string, force bool, rep reporter) error {
+	entries, err := readJournal(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		var err error
+		switch e := entries[i]; e.Op {
+		case "rename":
+			err = undoRename(e, rep)
+		case "rewrite":
+			err = undoRewrite(dir, e, force, rep)
+		case "relink":
+			err = undoRelink(e, force, rep)
+		default:
+			err = fmt.Errorf("unknown journal operation %q", e.Op)
+		}
+		if err != nil {
+			rep.failed(err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return os.WriteFile(filepath.Join(dir, "undone"), nil, 0600)
+}
+
+// readJournal parses the journal file at path.
+func readJournal(path string) ([]journalEntry, error) {
+	handle, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	defer handle.Close()
+
+	var entries []journalEntry
+	decoder := json.NewDecoder(handle)
+	for {
+		var e journalEntry
+		if err := decoder.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read journal %v: %w", path, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// undoRename moves e.NewPath back to e.Path.
+func undoRename(e journalEntry, rep reporter) error {
+	_, errOld := os.Lstat(e.Path)
+	_, errNew := os.Lstat(e.NewPath)
+	if errOld == nil && errors.Is(errNew, os.ErrNotExist) {
+		// Already undone.
+		return nil
+	}
+	if errOld == nil {
+		return fmt.Errorf("refusing to rename %v back to %v: %v already exists", e.NewPath, e.Path, e.Path)
+	}
+	rep.noted(fmt.Sprintf("Renaming %v back to %v", e.NewPath, e.Path))
+	if err := os.Rename(e.NewPath, e.Path); err != nil {
+		return fmt.Errorf("rename %v back to %v: %w", e.NewPath, e.Path, err)
+	}
+	return nil
+}
+
+// undoRewrite restores e.Path to its original contents from the run's blobs,
+// provided it still holds what the run wrote (or force is set). A file with
+// other hard links is restored in place, so that they are restored too.
+func undoRewrite(dir string, e journalEntry, force bool, rep reporter) error {
+	current, err := checksumFile(e.Path)
+	if err != nil {
+		return fmt.Errorf("restore %v: %w", e.Path, err)
+	}
+	if current == e.Before {
+		// Already undone.
+		return nil
+	}
+	if current != e.After && !force {
+		return fmt.Errorf("refusing to restore %v: it has changed since the run (use --force to restore it anyway)", e.Path)
+	}
+
+	blob, err := os.Open(filepath.Join(dir, "blobs", e.Before))
+	if err != nil {
+		return fmt.Errorf("restore %v: %w", e.Path, err)
+	}
+	defer blob.Close()
+
+	f := &File{Path: e.Path}
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	tempName := filepath.Join(f.Dir(), RandomString(20))
+	temp, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return fmt.Errorf("create tempfile in %v: %w", f.Dir(), err)
+	}
+	defer os.Remove(tempName)
+	_, err = io.Copy(temp, blob)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("restore %v: %w", e.Path, err)
+	}
+	if err := preserveMetadata(tempName, e.Path, info); err != nil {
+		return err
+	}
+
+	rep.noted(fmt.Sprintf("Restoring %v", e.Path))
+	if _, ok := hardlinked(info); ok {
+		// Restore every hard link to the file, not just this one.
+		return f.CommitInPlace(tempName)
+	}
+	if err := os.Rename(tempName, e.Path); err != nil {
+		return fmt.Errorf("atomically move temp file %v to %v: %w", tempName, e.Path, err)
+	}
+	return nil
+}
+
+// undoRelink points the symlink e.Path back at e.Target, provided it still
+// points where the run left it (or force is set).
+func undoRelink(e journalEntry, force bool, rep reporter) error {
+	current, err := os.Readlink(e.Path)
+	if err != nil {
+		return fmt.Errorf("restore symlink %v: %w", e.Path, err)
+	}
+	if current == e.Target {
+		// Already undone.
+		return nil
+	}
+	if current != e.NewTarget && !force {
+		return fmt.Errorf("refusing to restore symlink %v: it has changed since the run (use --force to restore it anyway)", e.Path)
+	}
+
+	tempName := filepath.Join(filepath.Dir(e.Path), RandomString(20))
+	if err := os.Symlink(e.Target, tempName); err != nil {
+		return fmt.Errorf("restore symlink %v: %w", e.Path, err)
+	}
+	defer os.Remove(tempName)
+	rep.noted(fmt.Sprintf("Pointing symlink %v back to %v", e.Path, e.Target))
+	if err := os.Rename(tempName, e.Path); err != nil {
+		return fmt.Errorf("atomically move temp file %v to %v: %w", tempName, e.Path, err)
+	}
+	return nil
+}
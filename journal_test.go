@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runOrFatal calls run with args, failing the test unless it exits with 0.
+func runOrFatal(t *testing.T, args ...string) {
+	t.Helper()
+	var stderr bytes.Buffer
+	if got := run(append([]string{"find-replace"}, args...), nil, io.Discard, &stderr); got != 0 {
+		t.Fatalf("run %v = %d; want 0 (stderr: %q)", args, got, stderr.String())
+	}
+}
+
+// assertNotExist fails the test if anything exists at path.
+func assertNotExist(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = %v; want it not to exist", path, err)
+	}
+}
+
+func TestUndo_RestoresRun(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	original := map[string]string{
+		"alpha/alpha.txt": "alpha\n",
+		"alpha/keep.txt":  "unchanged\n",
+		"big-alpha.log":   strings.Repeat("alpha ", 100),
+	}
+	writeTree(t, dir, original)
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--stream-threshold", "100", "alpha", "beta")
+	assertTree(t, dir, map[string]string{"beta/beta.txt": "beta\n", "big-beta.log": strings.Repeat("beta ", 100)})
+
+	runOrFatal(t, "undo")
+	assertTree(t, dir, original)
+	assertNotExist(t, filepath.Join(dir, "beta"))
+	assertNotExist(t, filepath.Join(dir, "big-beta.log"))
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "undo"}, nil, io.Discard, &stderr); got != 1 {
+		t.Errorf("second undo = %d; want 1 with nothing left to undo", got)
+	}
+}
+
+func TestUndo_RefusesChangedFile(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "alpha", "b.txt": "alpha"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "alpha", "beta")
+	writeTree(t, dir, map[string]string{"b.txt": "edited since"})
+
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "undo"}, nil, io.Discard, &stderr); got != 1 {
+		t.Fatalf("undo = %d; want 1", got)
+	}
+	if !strings.Contains(stderr.String(), "refusing to restore") {
+		t.Errorf("stderr = %q; want it to explain the refusal", stderr.String())
+	}
+	assertTree(t, dir, map[string]string{"a.txt": "alpha", "b.txt": "edited since"})
+
+	// A second attempt picks up where the first left off.
+	runOrFatal(t, "undo", "--force")
+	assertTree(t, dir, map[string]string{"a.txt": "alpha", "b.txt": "alpha"})
+}
+
+func TestRun_NoJournalForUnchangedRun(t *testing.T) {
+	state := t.TempDir()
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "gamma"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--state-dir", state, "alpha", "beta")
+	runOrFatal(t, "--state-dir", state, "--dry-run", "gamma", "delta")
+	runs, err := os.ReadDir(filepath.Join(state, "runs"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(runs) != 0 {
+		t.Errorf("state directory holds %d journals; want none", len(runs))
+	}
+}
+
+func TestRun_WithoutStateDirectory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "")
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "alpha"})
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	// Without anywhere to keep it, the run goes ahead without a journal.
+	runOrFatal(t, "alpha", "beta")
+	assertTree(t, dir, map[string]string{"a.txt": "beta"})
+	if !strings.Contains(logs.String(), "Not recording this run for undo") {
+		t.Errorf("log output = %q; want a warning that the run can't be undone", logs.String())
+	}
+
+	// A --state-dir that can't be used is an error, though.
+	var stderr bytes.Buffer
+	stateDir := filepath.Join(dir, "a.txt", "state")
+	if got := run([]string{"find-replace", "--state-dir", stateDir, "beta", "gamma"}, nil, io.Discard, &stderr); got != 1 {
+		t.Errorf("run with an unusable --state-dir = %d; want 1", got)
+	}
+	assertTree(t, dir, map[string]string{"a.txt": "beta"})
+}
+
+func TestRun_PrunesJournals(t *testing.T) {
+	state := t.TempDir()
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "alpha"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	for i := 0; i < keptRuns+2; i++ {
+		runOrFatal(t, "--state-dir", state, "alpha", "beta")
+		runOrFatal(t, "--state-dir", state, "beta", "alpha")
+	}
+	runs, err := os.ReadDir(filepath.Join(state, "runs"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(runs) != keptRuns {
+		t.Errorf("state directory holds %d journals; want %d", len(runs), keptRuns)
+	}
+
+	// The latest runs can still be undone.
+	runOrFatal(t, "undo", "--state-dir", state)
+	assertTree(t, dir, map[string]string{"a.txt": "beta"})
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// matchOptions selects how the find pattern is interpreted.
+type matchOptions struct {
+	// regexp treats find as a regular expression.
+	regexp bool
+
+	// ignoreCase matches find regardless of case, using Unicode simple case
+	// folding.
+	ignoreCase bool
+
+	// preserveCase matches every case variant of find, and rewrites each
+	// with replace in the same case shape.
+	preserveCase bool
+
+	// identifiers treats find and replace as lists of words, and maps each
+	// identifier style of find (camelCase, snake_case, ...) to the same
+	// style of replace.
+	identifiers bool
+
+	// word only accepts matches that sit on word boundaries, where a word
+	// is a run of characters matching the regular expression character
+	// class wordChars (defaultWordChars if empty).
+	word      bool
+	wordChars string
+}
+
+// defaultWordChars is the character class --word treats as part of a word:
+// letters, digits and underscores, which covers identifiers in most
+// languages.
+const defaultWordChars = `[\p{L}\p{N}_]`
+
+// newMatcher returns the matcher for find and replace under opts. It returns
+// an error if find or wordChars is not a valid regular expression, or if
+// opts combines modes that do not make sense together.
+func newMatcher(find string, replace string, opts matchOptions) (matcher, error) {
+	m, err := newBaseMatcher(find, replace, opts)
+	if err != nil || !opts.word {
+		return m, err
+	}
+
+	class := opts.wordChars
+	if class == "" {
+		class = defaultWordChars
+	}
+	re, err := regexp.Compile("^(?:" + class + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid word character class %q: %w", class, err)
+	}
+	return wordMatcher{inner: m.(resumableMatcher), wordChar: re}, nil
+}
+
+// newBaseMatcher returns the matcher for find and replace under opts,
+// ignoring word boundaries.
+func newBaseMatcher(find string, replace string, opts matchOptions) (matcher, error) {
+	if opts.identifiers {
+		if opts.regexp || opts.ignoreCase || opts.preserveCase {
+			return nil, errors.New("--identifiers cannot be combined with --regex, --ignore-case or --preserve-case")
+		}
+		return newIdentifierMatcher(find, replace)
+	}
+	if opts.preserveCase {
+		if opts.regexp {
+			return nil, errors.New("--preserve-case cannot be combined with --regex")
+		}
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(find))
+		return preserveCaseMatcher{re: re, find: find, replace: replace}, nil
+	}
+	if !opts.regexp && !opts.ignoreCase {
+		return literalMatcher{find: find, replace: replace}, nil
+	}
+
+	pattern := find
+	if !opts.regexp {
+		pattern = regexp.QuoteMeta(find)
+	}
+	if opts.ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %w", find, err)
+	}
+	resume := regexp.MustCompile(`\A(?s:.)(?s:.*?)(` + pattern + `)`)
+	return regexpMatcher{re: re, find: find, replace: replace, literal: !opts.regexp, resume: resume}, nil
+}
+
+// match is a single occurrence of the find pattern: the byte offsets of the
+// matched text, and the text it should be replaced with.
+type match struct {
+	start       int
+	end         int
+	replacement string
+
+	// style names the identifier style the match was found in, for
+	// matchers that distinguish them; it is empty otherwise.
+	style string
+
+	// ambiguous is set when the matcher could not work out a replacement,
+	// such as a mixed-case match under --preserve-case. Its replacement is
+	// the matched text itself, so replacing it is a no-op; callers should
+	// report it instead.
+	ambiguous bool
+}
+
+// matcher locates every occurrence of the find pattern in a string and works
+// out what each occurrence should be replaced with. Matches are returned in
+// order and never overlap.
+type matcher interface {
+	findAll(s string) []match
+}
+
+// resumableMatcher is a matcher that can also find its first match that
+// starts at or after from in s, with what comes before from as context for
+// anchors such as ^ and \b, so that a search can carry on from the middle of
+// a string.
+type resumableMatcher interface {
+	matcher
+	findFrom(s string, from int) (match, bool)
+}
+
+// literalMatcher matches find exactly, like strings.ReplaceAll.
+type literalMatcher struct {
+	find    string
+	replace string
+}
+
+func (m literalMatcher) findAll(s string) []match {
+	if m.find == "" {
+		return nil
+	}
+	var matches []match
+	for i := 0; ; {
+		j := strings.Index(s[i:], m.find)
+		if j < 0 {
+			return matches
+		}
+		start := i + j
+		i = start + len(m.find)
+		matches = append(matches, match{start: start, end: i, replacement: m.replace})
+	}
+}
+
+func (m literalMatcher) findFrom(s string, from int) (match, bool) {
+	if m.find == "" {
+		return match{}, false
+	}
+	i := strings.Index(s[from:], m.find)
+	if i < 0 {
+		return match{}, false
+	}
+	return match{start: from + i, end: from + i + len(m.find), replacement: m.replace}, true
+}
+
+// regexpMatcher matches a regular expression. Unless literal is set,
+// replace is expanded for each match as in regexp.Expand, so $1 or ${name}
+// refer to the match's capture groups. When literal is set, re matches the
+// literal string find (possibly ignoring case).
+type regexpMatcher struct {
+	re      *regexp.Regexp
+	find    string
+	replace string
+	literal bool
+
+	// resume is re after one character of context and the shortest run of
+	// anything, with re's match as its first group, for findFrom.
+	resume *regexp.Regexp
+}
+
+func (m regexpMatcher) findAll(s string) []match {
+	var matches []match
+	for _, loc := range m.re.FindAllStringSubmatchIndex(s, -1) {
+		matches = append(matches, m.matchAt(s, loc))
+	}
+	return matches
+}
+
+// findFrom searches from the character before from with m.resume, since
+// searching s[from:] would let ^ and \b match at from whatever comes before
+// it.
+func (m regexpMatcher) findFrom(s string, from int) (match, bool) {
+	if from == 0 {
+		loc := m.re.FindStringSubmatchIndex(s)
+		if loc == nil {
+			return match{}, false
+		}
+		return m.matchAt(s, loc), true
+	}
+	_, size := utf8.DecodeLastRuneInString(s[:from])
+	offset := from - size
+	loc := m.resume.FindStringSubmatchIndex(s[offset:])
+	if loc == nil {
+		return match{}, false
+	}
+	// Drop the whole match of m.resume, leaving re's match and groups.
+	loc = loc[2:]
+	for i := range loc {
+		if loc[i] >= 0 {
+			loc[i] += offset
+		}
+	}
+	return m.matchAt(s, loc), true
+}
+
+// matchAt returns the match of re in s at loc, as found by
+// FindStringSubmatchIndex.
+func (m regexpMatcher) matchAt(s string, loc []int) match {
+	replacement := m.replace
+	if !m.literal {
+		replacement = string(m.re.ExpandString(nil, m.replace, s, loc))
+	}
+	return match{start: loc[0], end: loc[1], replacement: replacement}
+}
+
+// literalPair is a single find/replace pair within a multiLiteralMatcher.
+type literalPair struct {
+	find    string
+	replace string
+	style   string
+}
+
+// multiLiteralMatcher matches several literal strings at once, in a single
+// pass over the text however many there are. At each position it takes the
+// leftmost match, preferring the longest pair and then the earliest; text
+// that has been replaced is never matched again, so one pair's replacement
+// can never be matched by another pair.
+type multiLiteralMatcher struct {
+	pairs     []literalPair
+	automaton *acAutomaton
+}
+
+// newMultiLiteralMatcher returns a multiLiteralMatcher for pairs.
+func newMultiLiteralMatcher(pairs []literalPair) multiLiteralMatcher {
+	patterns := make([]string, len(pairs))
+	for i, pair := range pairs {
+		patterns[i] = pair.find
+	}
+	return multiLiteralMatcher{pairs: pairs, automaton: newACAutomaton(patterns)}
+}
+
+func (m multiLiteralMatcher) findAll(s string) []match {
+	var matches []match
+	for _, found := range m.automaton.findAll(s) {
+		matches = append(matches, m.matchFor(found))
+	}
+	return matches
+}
+
+func (m multiLiteralMatcher) findFrom(s string, from int) (match, bool) {
+	found, ok := m.automaton.findFrom(s, from)
+	if !ok {
+		return match{}, false
+	}
+	return m.matchFor(found), true
+}
+
+// matchFor returns the match for an occurrence of one of m's pairs.
+func (m multiLiteralMatcher) matchFor(found acMatch) match {
+	pair := m.pairs[found.pattern]
+	return match{start: found.start, end: found.end, replacement: pair.replace, style: pair.style}
+}
+
+// preserveCaseMatcher matches find regardless of case, and replaces each
+// match with replace in the same case shape: lowercase, UPPERCASE, Title
+// case, or the exact (or first-letter-toggled) casing of find itself.
+// Matches that fit none of those shapes are left alone and marked ambiguous.
+type preserveCaseMatcher struct {
+	re      *regexp.Regexp
+	find    string
+	replace string
+}
+
+func (m preserveCaseMatcher) findAll(s string) []match {
+	var matches []match
+	for _, loc := range m.re.FindAllStringIndex(s, -1) {
+		matches = append(matches, m.matchAt(s, loc[0], loc[1]))
+	}
+	return matches
+}
+
+// findFrom can search s[from:] on its own, since re matches nothing but
+// find, regardless of case.
+func (m preserveCaseMatcher) findFrom(s string, from int) (match, bool) {
+	loc := m.re.FindStringIndex(s[from:])
+	if loc == nil {
+		return match{}, false
+	}
+	return m.matchAt(s, from+loc[0], from+loc[1]), true
+}
+
+// matchAt returns the match of s[start:end], in whichever case it is in.
+func (m preserveCaseMatcher) matchAt(s string, start int, end int) match {
+	text := s[start:end]
+	replacement, ok := m.replacementFor(text)
+	if !ok {
+		replacement = text
+	}
+	return match{start: start, end: end, replacement: replacement, ambiguous: !ok}
+}
+
+// replacementFor returns replace in the case shape of text, or false if
+// text's shape is not one that can be carried over.
+func (m preserveCaseMatcher) replacementFor(text string) (string, bool) {
+	switch text {
+	case m.find:
+		return m.replace, true
+	case strings.ToLower(text):
+		return strings.ToLower(m.replace), true
+	case strings.ToUpper(text):
+		return strings.ToUpper(m.replace), true
+	case upperFirst(strings.ToLower(text)):
+		return upperFirst(m.replace), true
+	case upperFirst(m.find):
+		return upperFirst(m.replace), true
+	case lowerFirst(m.find):
+		return lowerFirst(m.replace), true
+	}
+	return "", false
+}
+
+// wordMatcher filters the matches of inner down to those that sit on word
+// boundaries: a match may not start in the middle of a word, nor end in the
+// middle of one. Which characters make up a word is decided by wordChar, a
+// regular expression that must match the whole of a single character.
+// Since a rejected match may hide one that overlaps it, the search resumes
+// just after the start of each rejected match, as grep -w does.
+type wordMatcher struct {
+	inner    resumableMatcher
+	wordChar *regexp.Regexp
+}
+
+func (m wordMatcher) findAll(s string) []match {
+	return m.findAllFrom(s, 0)
+}
+
+// findAllFrom is findAll for the part of s from from on, with what comes
+// before it as context.
+func (m wordMatcher) findAllFrom(s string, from int) []match {
+	var matches []match
+	lastEnd := -1
+	for from >= 0 && from <= len(s) {
+		found, ok := m.findFrom(s, from)
+		if !ok {
+			break
+		}
+		empty := found.start == found.end
+		if empty && found.start == lastEnd {
+			// Like regexp's FindAll, skip an empty match right
+			// after the match before it.
+			from = afterFirstRune(s, found.start)
+			continue
+		}
+		matches = append(matches, found)
+		lastEnd, from = found.end, found.end
+		if empty {
+			from = afterFirstRune(s, found.end)
+		}
+	}
+	return matches
+}
+
+// findFrom returns the first match of inner from from on that sits on word
+// boundaries. Each search only goes as far as the next candidate, so however
+// many are rejected, s is scanned about once.
+func (m wordMatcher) findFrom(s string, from int) (match, bool) {
+	for from >= 0 && from <= len(s) {
+		candidate, ok := m.inner.findFrom(s, from)
+		if !ok {
+			break
+		}
+		if m.onBoundaries(s, candidate) {
+			return candidate, true
+		}
+		from = afterFirstRune(s, candidate.start)
+	}
+	return match{}, false
+}
+
+// afterFirstRune returns the offset just past the rune of s at i, or -1 if i
+// is the end of s.
+func afterFirstRune(s string, i int) int {
+	if i >= len(s) {
+		return -1
+	}
+	_, size := utf8.DecodeRuneInString(s[i:])
+	return i + size
+}
+
+// onBoundaries reports whether the text on either side of c continues a word
+// that c starts or ends.
+func (m wordMatcher) onBoundaries(s string, c match) bool {
+	first, _ := utf8.DecodeRuneInString(s[c.start:c.end])
+	before, _ := utf8.DecodeLastRuneInString(s[:c.start])
+	if c.start > 0 && m.isWordRune(before) && (c.start == c.end || m.isWordRune(first)) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(s[c.start:c.end])
+	after, _ := utf8.DecodeRuneInString(s[c.end:])
+	if c.end < len(s) && m.isWordRune(after) && (c.start == c.end || m.isWordRune(last)) {
+		return false
+	}
+	return true
+}
+
+// isWordRune reports whether r is one of the configured word characters.
+func (m wordMatcher) isWordRune(r rune) bool {
+	return m.wordChar.MatchString(string(r))
+}
+
+// upperFirst returns s with its first rune in upper case.
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// lowerFirst returns s with its first rune in lower case.
+func lowerFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[size:]
+}
+
+// replaceMatches returns s with every match substituted by its replacement.
+func replaceMatches(s string, matches []match) string {
+	if len(matches) == 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(s[last:m.start])
+		b.WriteString(m.replacement)
+		last = m.end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// assertReplaced ensures that replacing every match of m in s produces want.
+func assertReplaced(t *testing.T, m matcher, s string, want string) {
+	t.Helper()
+	if got := replaceMatches(s, m.findAll(s)); got != want {
+		t.Errorf("replace in %q = %q; want %q", s, got, want)
+	}
+}
+
+func TestLiteralMatcher(t *testing.T) {
+	m := literalMatcher{find: "ph", replace: "f"}
+	assertReplaced(t, m, "alpha", "alfa")
+	assertReplaced(t, m, "alphaalpha", "alfaalfa")
+	assertReplaced(t, m, "alpha\nalpha", "alfa\nalfa")
+	assertReplaced(t, m, "beta", "beta")
+}
+
+func TestLiteralMatcherNonOverlapping(t *testing.T) {
+	assertReplaced(t, literalMatcher{find: "aa", replace: "b"}, "aaaaa", "bba")
+}
+
+func TestLiteralMatcherEmptyFind(t *testing.T) {
+	if got := (literalMatcher{find: "", replace: "x"}).findAll("alpha"); len(got) != 0 {
+		t.Errorf("findAll with empty find = %v; want no matches", got)
+	}
+}
+
+func TestRegexpMatcherCaptureGroups(t *testing.T) {
+	m := regexpMatcher{re: regexp.MustCompile(`v(\d+)\.(\d+)`), replace: "v${1}_$2"}
+	assertReplaced(t, m, "v1.2 and v10.20", "v1_2 and v10_20")
+}
+
+func TestRegexpMatcherNamedGroups(t *testing.T) {
+	m := regexpMatcher{re: regexp.MustCompile(`(?P<first>\w+)@(?P<second>\w+)`), replace: "${second}@${first}"}
+	assertReplaced(t, m, "alpha@beta", "beta@alpha")
+}
+
+func TestRegexpMatcherLiteral(t *testing.T) {
+	m := regexpMatcher{re: regexp.MustCompile(`a(l)pha`), replace: "$1", literal: true}
+	assertReplaced(t, m, "alpha", "$1")
+}
+
+// newMatcherOrFatal wraps newMatcher for tests whose patterns are valid.
+func newMatcherOrFatal(tb testing.TB, find string, replace string, opts matchOptions) matcher {
+	tb.Helper()
+	m, err := newMatcher(find, replace, opts)
+	if err != nil {
+		tb.Fatalf("newMatcher(%q, %q, %+v): %v", find, replace, opts, err)
+	}
+	return m
+}
+
+func TestNewMatcherIgnoreCase(t *testing.T) {
+	m := newMatcherOrFatal(t, "alpha", "beta", matchOptions{ignoreCase: true})
+	assertReplaced(t, m, "alpha Alpha ALPHA aLpHa", "beta beta beta beta")
+}
+
+func TestNewMatcherIgnoreCaseQuotesMetacharacters(t *testing.T) {
+	m := newMatcherOrFatal(t, "a.b", "$1", matchOptions{ignoreCase: true})
+	assertReplaced(t, m, "A.B axb", "$1 axb")
+}
+
+func TestNewMatcherIgnoreCaseUnicode(t *testing.T) {
+	m := newMatcherOrFatal(t, "straße", "weg", matchOptions{ignoreCase: true})
+	assertReplaced(t, m, "Straße STRAẞE", "weg weg")
+
+	m = newMatcherOrFatal(t, "άλφα", "beta", matchOptions{ignoreCase: true})
+	assertReplaced(t, m, "ΆΛΦΑ Άλφα", "beta beta")
+
+	// U+212A KELVIN SIGN folds to k, and U+017F LATIN SMALL LETTER LONG S
+	// folds to s; both differ in byte length from their ASCII equivalents.
+	m = newMatcherOrFatal(t, "ks", "x", matchOptions{ignoreCase: true})
+	assertReplaced(t, m, "\u212a\u017f KS", "x x")
+}
+
+func TestNewMatcherIgnoreCaseRegexp(t *testing.T) {
+	m := newMatcherOrFatal(t, `v(\d+)`, "version$1", matchOptions{regexp: true, ignoreCase: true})
+	assertReplaced(t, m, "v1 V2", "version1 version2")
+}
+
+func TestNewMatcherInvalidRegexp(t *testing.T) {
+	if _, err := newMatcher("(alpha", "beta", matchOptions{regexp: true}); err == nil {
+		t.Errorf("newMatcher with an unbalanced group: err = nil; want an error")
+	}
+}
+
+func TestNewMatcherPreserveCase(t *testing.T) {
+	m := newMatcherOrFatal(t, "foo", "bar", matchOptions{preserveCase: true})
+	assertReplaced(t, m, "foo Foo FOO", "bar Bar BAR")
+}
+
+func TestNewMatcherPreserveCaseCamelCase(t *testing.T) {
+	m := newMatcherOrFatal(t, "fooBar", "bazQux", matchOptions{preserveCase: true})
+	assertReplaced(t, m, "fooBar FooBar foobar FOOBAR", "bazQux BazQux bazqux BAZQUX")
+}
+
+func TestNewMatcherPreserveCaseUnicode(t *testing.T) {
+	m := newMatcherOrFatal(t, "émile", "zoé", matchOptions{preserveCase: true})
+	assertReplaced(t, m, "émile Émile ÉMILE", "zoé Zoé ZOÉ")
+}
+
+func TestNewMatcherPreserveCaseAmbiguous(t *testing.T) {
+	m := newMatcherOrFatal(t, "foo", "bar", matchOptions{preserveCase: true})
+	matches := m.findAll("fOo and foo")
+	if len(matches) != 2 {
+		t.Fatalf("findAll = %v; want 2 matches", matches)
+	}
+	if !matches[0].ambiguous {
+		t.Errorf("match of %q is not ambiguous; want it reported rather than guessed", "fOo")
+	}
+	if matches[1].ambiguous {
+		t.Errorf("match of %q is ambiguous; want it replaced", "foo")
+	}
+	assertReplaced(t, m, "fOo and foo", "fOo and bar")
+}
+
+func TestNewMatcherPreserveCaseRejectsRegexp(t *testing.T) {
+	if _, err := newMatcher("foo", "bar", matchOptions{preserveCase: true, regexp: true}); err == nil {
+		t.Errorf("newMatcher with --preserve-case and --regex: err = nil; want an error")
+	}
+}
+
+func TestMultiLiteralMatcherLeftmostLongest(t *testing.T) {
+	m := newMultiLiteralMatcher([]literalPair{
+		{find: "ab", replace: "1"},
+		{find: "abc", replace: "2"},
+		{find: "bcd", replace: "3"},
+	})
+	// "abc" beats "ab" at the same offset, and "bcd" overlaps it so is
+	// never matched.
+	assertReplaced(t, m, "abcd", "2d")
+	assertReplaced(t, m, "xbcdab", "x31")
+}
+
+func TestMultiLiteralMatcherDoesNotRematchReplacements(t *testing.T) {
+	m := newMultiLiteralMatcher([]literalPair{
+		{find: "alpha", replace: "beta"},
+		{find: "beta", replace: "gamma"},
+	})
+	assertReplaced(t, m, "alpha beta", "beta gamma")
+}
+
+func TestNewMatcherWord(t *testing.T) {
+	m := newMatcherOrFatal(t, "virt", "subvert", matchOptions{word: true})
+	assertReplaced(t, m, "virt virtual libvirt virt_x virt.py (virt)", "subvert virtual libvirt virt_x subvert.py (subvert)")
+}
+
+func TestNewMatcherWordUnicode(t *testing.T) {
+	m := newMatcherOrFatal(t, "café", "bar", matchOptions{word: true})
+	assertReplaced(t, m, "café cafés écafé café", "bar cafés écafé bar")
+}
+
+func TestNewMatcherWordChars(t *testing.T) {
+	// By default a hyphen ends a word, so "color" matches in "color-primary".
+	m := newMatcherOrFatal(t, "color", "colour", matchOptions{word: true})
+	assertReplaced(t, m, "color: var(--color-primary)", "colour: var(--colour-primary)")
+
+	// Counting hyphens as word characters keeps CSS identifiers whole.
+	m = newMatcherOrFatal(t, "color", "colour", matchOptions{word: true, wordChars: `[\w-]`})
+	assertReplaced(t, m, "color: var(--color-primary)", "colour: var(--color-primary)")
+}
+
+func TestNewMatcherWordPatternEdges(t *testing.T) {
+	// A match that starts or ends with a non-word character may touch a
+	// word on that side.
+	m := newMatcherOrFatal(t, "-flag", "-option", matchOptions{word: true})
+	assertReplaced(t, m, "cmd-flag cmd -flags", "cmd-option cmd -flags")
+}
+
+func TestNewMatcherWordWithRegexp(t *testing.T) {
+	m := newMatcherOrFatal(t, `v\d+`, "vN", matchOptions{word: true, regexp: true})
+	assertReplaced(t, m, "v1 v22 xv3 v4x", "vN vN xv3 v4x")
+}
+
+func TestNewMatcherWordOverlapping(t *testing.T) {
+	// The first candidate starts inside "xfoo" and is rejected; the match
+	// that overlaps it, just after, is still found.
+	m := newMatcherOrFatal(t, "foo foo", "Z", matchOptions{word: true})
+	assertReplaced(t, m, "xfoo foo foo", "xfoo Z")
+	m = newMatcherOrFatal(t, "aa", "b", matchOptions{word: true})
+	assertReplaced(t, m, "aaa aa", "aaa b")
+}
+
+func TestNewMatcherWordKeepsAnchors(t *testing.T) {
+	// After "a-" is rejected inside "ba-x", the search carries on from the
+	// middle of the line, where ^ must not match.
+	m := newMatcherOrFatal(t, `a-|^-x`, "Z", matchOptions{word: true, regexp: true})
+	assertReplaced(t, m, "ba-x", "ba-x")
+	assertReplaced(t, m, "-x ba-x", "Z ba-x")
+
+	m = newMatcherOrFatal(t, `\bfoo`, "Z", matchOptions{word: true, regexp: true})
+	assertReplaced(t, m, "xfoo foo", "xfoo Z")
+}
+
+func TestNewMatcherInvalidWordChars(t *testing.T) {
+	if _, err := newMatcher("alpha", "beta", matchOptions{word: true, wordChars: "[a-"}); err == nil {
+		t.Errorf("newMatcher with an invalid word character class: err = nil; want an error")
+	}
+}
+
+// BenchmarkWordMatcher matches a word that mostly appears inside other
+// words, so that nearly every candidate is rejected.
+func BenchmarkWordMatcher(b *testing.B) {
+	s := strings.Repeat("the virtual machine uses libvirt and virt\n", 20000)
+	for name, opts := range map[string]matchOptions{
+		"literal": {word: true},
+		"regexp":  {word: true, regexp: true},
+	} {
+		m, err := newMatcher("virt", "subvert", opts)
+		if err != nil {
+			b.Fatalf("newMatcher: %v", err)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.findAll(s)
+			}
+		})
+	}
+}
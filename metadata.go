@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// preserveMetadata gives temp, a file about to replace src, the attributes
+// of src (described by info) that creating it anew would lose: its owner and
+// group, its extended attributes (which hold ACLs and SELinux labels), and
+// its exact permission bits, including setuid, setgid and sticky, which the
+// umask would otherwise mask.
+func preserveMetadata(temp string, src string, info os.FileInfo) error {
+	// Changing the owner clears setuid and setgid, and file capabilities
+	// (an extended attribute), so it has to come first.
+	if err := copyOwner(temp, info); err != nil {
+		return fmt.Errorf("preserve owner of %v: %w", src, err)
+	}
+	if err := copyXattrs(temp, src); err != nil {
+		return fmt.Errorf("preserve extended attributes of %v: %w", src, err)
+	}
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(temp, mode); err != nil {
+		return fmt.Errorf("preserve mode of %v: %w", src, err)
+	}
+	return nil
+}
+
+// preserveModTime gives temp, a file about to replace src, the access and
+// modification times of src, described by info, for --preserve-mtime.
+func preserveModTime(temp string, src string, info os.FileInfo) error {
+	if err := os.Chtimes(temp, accessTime(info), info.ModTime()); err != nil {
+		return fmt.Errorf("preserve modification time of %v: %w", src, err)
+	}
+	return nil
+}
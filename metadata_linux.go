@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// copyOwner gives temp the owner and group in info. Only root may give a
+// file away, so for anyone else this is done where permitted, and a file
+// they could rewrite but don't own otherwise becomes theirs, as it always
+// has.
+func copyOwner(temp string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := os.Lchown(temp, int(stat.Uid), int(stat.Gid))
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
+
+// copyXattrs makes the extended attributes of temp the same as those of src.
+// Attributes that the file system doesn't support, or that only root may
+// set, are left out.
+func copyXattrs(temp string, src string) error {
+	names, err := listXattrs(src)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// temp may have been given attributes of its own, such as a default
+	// ACL inherited from its directory.
+	stale, err := listXattrs(temp)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if errors.Is(err, syscall.ENODATA) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = syscall.Setxattr(temp, name, value, 0)
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOTSUP) {
+			continue
+		} else if err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: temp, Err: err}
+		}
+		kept[name] = true
+	}
+	for _, name := range stale {
+		if !kept[name] {
+			syscall.Removexattr(temp, name)
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattr(path, "listxattr", func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path string, name string) ([]byte, error) {
+	return readXattr(path, "getxattr "+name, func(dest []byte) (int, error) {
+		return syscall.Getxattr(path, name, dest)
+	})
+}
+
+// readXattr calls read, a syscall that fills dest, first to learn the size
+// of the result and then to fetch it, trying again if it grew in between.
+func readXattr(path string, op string, read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+// accessTime returns when the file described by info was last read.
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// rewriteModes runs a test once for a rewrite read into memory, and once for
+// a streamed one, which are staged differently.
+var rewriteModes = map[string][]string{
+	"in memory": {"--stream-threshold", "0"},
+	"streamed":  {"--stream-threshold", "1"},
+}
+
+// runRewrite writes "alpha" to a file in a new directory, calls prepare to
+// set it up, rewrites it with args, and returns its path.
+func runRewrite(t *testing.T, prepare func(path string), args ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	prepare(path)
+	withWorkingDir(t, dir)
+	captureLog(t)
+	runOrFatal(t, append(args, "alpha", "beta")...)
+	assertTree(t, dir, map[string]string{"file.txt": "beta"})
+	return path
+}
+
+func TestRewritePreservesMode(t *testing.T) {
+	mode := os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0777
+	for name, args := range rewriteModes {
+		path := runRewrite(t, func(path string) {
+			if err := os.Chmod(path, mode); err != nil {
+				t.Fatalf("Chmod: %v", err)
+			}
+		}, args...)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := info.Mode(); got != mode {
+			t.Errorf("%v: mode after rewrite = %v; want %v", name, got, mode)
+		}
+	}
+}
+
+func TestRewritePreservesOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can give a file away")
+	}
+	for name, args := range rewriteModes {
+		path := runRewrite(t, func(path string) {
+			if err := os.Chown(path, 1234, 5678); err != nil {
+				t.Fatalf("Chown: %v", err)
+			}
+		}, args...)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1234 || stat.Gid != 5678 {
+			t.Errorf("%v: owner after rewrite = %d:%d; want 1234:5678", name, stat.Uid, stat.Gid)
+		}
+	}
+}
+
+func TestRewritePreservesXattrs(t *testing.T) {
+	for name, args := range rewriteModes {
+		path := runRewrite(t, func(path string) {
+			err := syscall.Setxattr(path, "user.find-replace", []byte("kept"), 0)
+			if errors.Is(err, syscall.ENOTSUP) {
+				t.Skip("the file system doesn't support extended attributes")
+			} else if err != nil {
+				t.Fatalf("Setxattr: %v", err)
+			}
+		}, args...)
+		names, err := listXattrs(path)
+		if err != nil {
+			t.Fatalf("listXattrs: %v", err)
+		}
+		value, err := getXattr(path, "user.find-replace")
+		if err != nil || string(value) != "kept" || len(names) != 1 {
+			t.Errorf("%v: extended attributes after rewrite = %q, user.find-replace = %q (%v); want only user.find-replace = kept", name, names, value, err)
+		}
+	}
+}
+
+func TestRewritePreservesMtime(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	setMtime := func(path string) {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	for name, args := range rewriteModes {
+		for _, preserve := range []bool{false, true} {
+			if preserve {
+				args = append([]string{"--preserve-mtime"}, args...)
+			}
+			info, err := os.Stat(runRewrite(t, setMtime, args...))
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if got := info.ModTime(); got.Equal(mtime) != preserve {
+				t.Errorf("%v: modification time after rewrite with %v = %v; want it kept only with --preserve-mtime", name, args, got)
+			}
+		}
+	}
+}
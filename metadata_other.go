@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Elsewhere than Linux, only the permission bits and times of a rewritten
+// file are preserved.
+
+func copyOwner(temp string, info os.FileInfo) error {
+	return nil
+}
+
+func copyXattrs(temp string, src string) error {
+	return nil
+}
+
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
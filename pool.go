@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// workerPool bounds how many goroutines the walker runs at once. Rather than
+// queueing work for a fixed set of workers, which can deadlock when every
+// worker is waiting on a directory whose children are still queued, run starts
+// a new goroutine for a task only while a slot is free, and otherwise runs
+// it on the calling goroutine. A goroutine waiting on its children therefore
+// never waits on work that has no one to run it.
+type workerPool struct {
+	once sync.Once
+
+	// jobs is the most goroutines allowed to work at once, including the
+	// one that started the walk. Values below 1 mean runtime.GOMAXPROCS.
+	jobs int
+
+	// slots holds a token for each goroutine started beyond the first.
+	slots chan struct{}
+}
+
+// run runs task, on a new goroutine if a slot is free or before returning
+// otherwise, and marks wg done once the task completes.
+func (p *workerPool) run(wg *sync.WaitGroup, task func()) {
+	p.once.Do(func() {
+		jobs := p.jobs
+		if jobs < 1 {
+			jobs = runtime.GOMAXPROCS(0)
+		}
+		p.slots = make(chan struct{}, jobs-1)
+	})
+
+	wg.Add(1)
+	select {
+	case p.slots <- struct{}{}:
+		go func() {
+			defer func() { <-p.slots }()
+			defer wg.Done()
+			task()
+		}()
+	default:
+		defer wg.Done()
+		task()
+	}
+}
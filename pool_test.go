@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	const jobs = 3
+	p := workerPool{jobs: jobs}
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	var spawn func(depth int)
+	spawn = func(depth int) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		if depth == 0 {
+			return
+		}
+		// Like WalkDir, wait for every child before returning.
+		var children sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			p.run(&children, func() { spawn(depth - 1) })
+		}
+		children.Wait()
+	}
+	p.run(&wg, func() { spawn(4) })
+	wg.Wait()
+
+	if peak > jobs {
+		t.Errorf("peak concurrency = %d; want at most %d", peak, jobs)
+	}
+}
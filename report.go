@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Reasons a path is skipped, as reported by reporter.skipped.
+const (
+	skipBinary   = "binary"
+	skipIgnored  = "ignored"
+	skipExcluded = "excluded"
+	skipSymlink  = "symlink"
+	skipHardlink = "hardlink"
+)
+
+// rewriteStats describes a rewrite: how many matches were replaced, and the
+// size of the file before and after.
+type rewriteStats struct {
+	matches     int
+	bytesBefore int64
+	bytesAfter  int64
+}
+
+// styleCount is the number of replacements made in an identifier style.
+type styleCount struct {
+	style string
+	count int
+}
+
+// reporter receives every event of a run, and is the only way anything
+// about a run's progress is printed. Implementations must be safe for
+// concurrent use.
+type reporter interface {
+	// scanned reports that the contents of the text file at path were
+	// searched.
+	scanned(path string)
+
+	// rewrote reports that path was rewritten, or would have been during
+	// a dry run.
+	rewrote(path string, stats rewriteStats, dryRun bool)
+
+	// renamed reports that oldPath was renamed to newPath, or would have
+	// been during a dry run.
+	renamed(oldPath string, newPath string, dryRun bool)
+
+	// relinked reports that the symlink at path was pointed from oldTarget
+	// to newTarget, or would have been during a dry run.
+	relinked(path string, oldTarget string, newTarget string, dryRun bool)
+
+	// skipped reports that path was left alone, for one of the skip
+	// reasons.
+	skipped(path string, reason string)
+
+	// warned reports something about path the operator should look at,
+	// such as a match that could not be replaced.
+	warned(path string, message string)
+
+	// noted reports the progress of the run as a whole.
+	noted(message string)
+
+	// failed reports an error. The run carries on.
+	failed(err error)
+
+	// finished reports the end of the run, with the hits per identifier
+	// style if they were counted.
+	finished(styles []styleCount)
+}
+
+// reporter returns the reporter events should go to, which defaults to
+// printing them as text.
+func (fr *findReplace) reporter() reporter {
+	if fr.report == nil {
+		return textReporter{}
+	}
+	return fr.report
+}
+
+// fail reports err and records it, so that the run exits non-zero.
+func (fr *findReplace) fail(err error) {
+	fr.reporter().failed(err)
+	fr.errs.add(err)
+}
+
+// textReporter prints events as lines of text to log.Default(), leaving out
+// the ones an operator watching a run doesn't need to see.
+type textReporter struct{}
+
+func (textReporter) scanned(path string) {}
+
+func (textReporter) rewrote(path string, stats rewriteStats, dryRun bool) {
+	if dryRun {
+		log.Printf("Would rewrite %v", path)
+	} else {
+		log.Printf("Rewriting %v", path)
+	}
+}
+
+// renamed prints the full new path of a dry run, since it takes every
+// rename above it into account, but only the new name of a real rename.
+func (textReporter) renamed(oldPath string, newPath string, dryRun bool) {
+	if dryRun {
+		log.Printf("Would rename %v to %v", oldPath, newPath)
+	} else {
+		log.Printf("Renaming %v to %v", oldPath, filepath.Base(newPath))
+	}
+}
+
+func (textReporter) relinked(path string, oldTarget string, newTarget string, dryRun bool) {
+	if dryRun {
+		log.Printf("Would point symlink %v to %v", path, newTarget)
+	} else {
+		log.Printf("Pointing symlink %v to %v", path, newTarget)
+	}
+}
+
+func (textReporter) skipped(path string, reason string) {}
+
+func (textReporter) warned(path string, message string) {
+	log.Print(message)
+}
+
+func (textReporter) noted(message string) {
+	log.Print(message)
+}
+
+func (textReporter) failed(err error) {
+	log.Print(err)
+}
+
+func (textReporter) finished(styles []styleCount) {
+	if styles == nil {
+		return
+	}
+	log.Print("Hits by identifier style:")
+	for _, s := range styles {
+		log.Printf("  %v: %d", s.style, s.count)
+	}
+}
+
+// jsonReporter writes each event to w as a line of JSON (NDJSON), ending with
+// a summary of the whole run.
+type jsonReporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	summary jsonSummary
+}
+
+// jsonSummary is the final event of a run reported as JSON.
+type jsonSummary struct {
+	Event     string         `json:"event"`
+	Scanned   int            `json:"scanned"`
+	Rewritten int            `json:"rewritten"`
+	Renamed   int            `json:"renamed"`
+	Relinked  int            `json:"relinked"`
+	Skipped   int            `json:"skipped"`
+	Errors    int            `json:"errors"`
+	Matches   int            `json:"matches"`
+	Styles    map[string]int `json:"styles,omitempty"`
+}
+
+// emit writes event as a line of JSON, having counted it with count.
+func (r *jsonReporter) emit(event interface{}, count func(s *jsonSummary)) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		// Every event is made of strings and numbers.
+		panic(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if count != nil {
+		count(&r.summary)
+	}
+	r.w.Write(append(line, '\n'))
+}
+
+func (r *jsonReporter) scanned(path string) {
+	r.emit(struct {
+		Event string `json:"event"`
+		Path  string `json:"path"`
+	}{"scan", path}, func(s *jsonSummary) { s.Scanned++ })
+}
+
+func (r *jsonReporter) rewrote(path string, stats rewriteStats, dryRun bool) {
+	r.emit(struct {
+		Event       string `json:"event"`
+		Path        string `json:"path"`
+		Matches     int    `json:"matches"`
+		BytesBefore int64  `json:"bytes_before"`
+		BytesAfter  int64  `json:"bytes_after"`
+		DryRun      bool   `json:"dry_run"`
+	}{"rewrite", path, stats.matches, stats.bytesBefore, stats.bytesAfter, dryRun}, func(s *jsonSummary) {
+		s.Rewritten++
+		s.Matches += stats.matches
+	})
+}
+
+func (r *jsonReporter) renamed(oldPath string, newPath string, dryRun bool) {
+	r.emit(struct {
+		Event   string `json:"event"`
+		OldPath string `json:"old_path"`
+		NewPath string `json:"new_path"`
+		DryRun  bool   `json:"dry_run"`
+	}{"rename", oldPath, newPath, dryRun}, func(s *jsonSummary) { s.Renamed++ })
+}
+
+func (r *jsonReporter) relinked(path string, oldTarget string, newTarget string, dryRun bool) {
+	r.emit(struct {
+		Event     string `json:"event"`
+		Path      string `json:"path"`
+		OldTarget string `json:"old_target"`
+		NewTarget string `json:"new_target"`
+		DryRun    bool   `json:"dry_run"`
+	}{"relink", path, oldTarget, newTarget, dryRun}, func(s *jsonSummary) { s.Relinked++ })
+}
+
+func (r *jsonReporter) skipped(path string, reason string) {
+	r.emit(struct {
+		Event  string `json:"event"`
+		Path   string `json:"path"`
+		Reason string `json:"reason"`
+	}{"skip", path, reason}, func(s *jsonSummary) { s.Skipped++ })
+}
+
+func (r *jsonReporter) warned(path string, message string) {
+	r.emit(struct {
+		Event   string `json:"event"`
+		Path    string `json:"path"`
+		Message string `json:"message"`
+	}{"warning", path, message}, nil)
+}
+
+func (r *jsonReporter) noted(message string) {
+	r.emit(struct {
+		Event   string `json:"event"`
+		Message string `json:"message"`
+	}{"note", message}, nil)
+}
+
+// failed includes the path the error is about, when there is one.
+func (r *jsonReporter) failed(err error) {
+	var path string
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) {
+		path = pathErr.Path
+	} else if errors.As(err, &linkErr) {
+		path = linkErr.Old
+	}
+	r.emit(struct {
+		Event string `json:"event"`
+		Path  string `json:"path,omitempty"`
+		Error string `json:"error"`
+	}{"error", path, err.Error()}, func(s *jsonSummary) { s.Errors++ })
+}
+
+func (r *jsonReporter) finished(styles []styleCount) {
+	r.mu.Lock()
+	summary := r.summary
+	r.mu.Unlock()
+	summary.Event = "summary"
+	for _, s := range styles {
+		if summary.Styles == nil {
+			summary.Styles = make(map[string]int)
+		}
+		summary.Styles[s.style] = s.count
+	}
+	r.emit(summary, nil)
+}
+
+// newReporter returns the reporter for --format, writing JSON events to w.
+func newReporter(format string, w io.Writer) (reporter, error) {
+	switch format {
+	case "text":
+		return textReporter{}, nil
+	case "json":
+		return &jsonReporter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown --format %q (want text or json)", format)
+}
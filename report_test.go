@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// runJSON runs find-replace --format=json with args, and returns its exit
+// code and the events it printed, decoded.
+func runJSON(t *testing.T, args ...string) (int, []map[string]interface{}) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"find-replace", "--format=json"}, args...), nil, &stdout, &stderr)
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("line %q of the output is not JSON: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return code, events
+}
+
+// describeEvents summarizes each event but the last as a line of text, with
+// paths relative to dir, sorted, since the walk is concurrent.
+func describeEvents(dir string, events []map[string]interface{}) []string {
+	rel := func(key string, event map[string]interface{}) string {
+		path, _ := event[key].(string)
+		if r, err := filepath.Rel(dir, path); err == nil {
+			return filepath.ToSlash(r)
+		}
+		return path
+	}
+	var lines []string
+	for _, event := range events[:len(events)-1] {
+		line := fmt.Sprintf("%v %v", event["event"], rel("path", event))
+		switch event["event"] {
+		case "rewrite":
+			line += fmt.Sprintf(" matches=%v before=%v after=%v dry_run=%v", event["matches"], event["bytes_before"], event["bytes_after"], event["dry_run"])
+		case "rename":
+			line = fmt.Sprintf("rename %v %v dry_run=%v", rel("old_path", event), rel("new_path", event), event["dry_run"])
+		case "skip":
+			line += " " + event["reason"].(string)
+		case "error":
+			line += " " + event["error"].(string)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestRun_FormatJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"alpha/notes.txt": "alpha alpha\n",
+		"clean.txt":       "nothing\n",
+		"ignored.txt":     "alpha\n",
+		".ignore":         "ignored.txt\n",
+		"vendor/alpha.go": "alpha\n",
+	})
+	if err := os.WriteFile(filepath.Join(dir, "image.bin"), []byte("\x00alpha"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	for _, dryRun := range []bool{true, false} {
+		args := []string{"--exclude", "vendor/", "alpha", "beta"}
+		if dryRun {
+			args = append([]string{"--dry-run"}, args...)
+		}
+		code, events := runJSON(t, args...)
+		if code != 0 {
+			t.Fatalf("run %v = %d; want 0", args, code)
+		}
+
+		want := []string{
+			fmt.Sprintf("rename alpha beta dry_run=%v", dryRun),
+			fmt.Sprintf("rewrite alpha/notes.txt matches=2 before=12 after=10 dry_run=%v", dryRun),
+			"scan .ignore",
+			"scan alpha/notes.txt",
+			"scan clean.txt",
+			"skip ignored.txt ignored",
+			"skip image.bin binary",
+			"skip vendor excluded",
+		}
+		if got := describeEvents(dir, events); !reflect.DeepEqual(got, want) {
+			t.Errorf("events of %v =\n%v\nwant\n%v", args, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+
+		summary := events[len(events)-1]
+		wantSummary := map[string]interface{}{
+			"event": "summary", "scanned": 3.0, "rewritten": 1.0, "renamed": 1.0,
+			"relinked": 0.0, "skipped": 3.0, "errors": 0.0, "matches": 2.0,
+		}
+		if !reflect.DeepEqual(summary, wantSummary) {
+			t.Errorf("summary of %v = %v; want %v", args, summary, wantSummary)
+		}
+	}
+	if logs.Len() != 0 {
+		t.Errorf("log output = %q; want none", logs.String())
+	}
+}
+
+func TestRun_FormatJSONReportsErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha.txt": "", "beta.txt": ""})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	code, events := runJSON(t, "--identifiers", "alpha", "beta", ".", "missing")
+	if code != 1 {
+		t.Errorf("run = %d; want 1", code)
+	}
+	missing := filepath.Join(dir, "missing")
+	want := []string{
+		// The path of an error is only known when the error carries it.
+		fmt.Sprintf("error missing stat %v: lstat %v: no such file or directory", missing, missing),
+		"error  " + fmt.Sprintf("refusing to rename %v to beta.txt: %v already exists", filepath.Join(dir, "alpha.txt"), filepath.Join(dir, "beta.txt")),
+		"scan alpha.txt",
+		"scan beta.txt",
+	}
+	sort.Strings(want)
+	if got := describeEvents(dir, events); !reflect.DeepEqual(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	summary := events[len(events)-1]
+	if summary["errors"] != 2.0 || summary["styles"] == nil {
+		t.Errorf("summary = %v; want 2 errors and the hits by style", summary)
+	}
+}
+
+func TestRun_FormatJSONConflicts(t *testing.T) {
+	for _, args := range [][]string{
+		{"--format=yaml", "alpha", "beta"},
+		{"--format=json", "--diff", "alpha", "beta"},
+		{"--format=json", "--check", "alpha", "beta"},
+	} {
+		var stderr bytes.Buffer
+		if got := run(append([]string{"find-replace"}, args...), nil, io.Discard, &stderr); got != 1 {
+			t.Errorf("run %v = %d; want 1", args, got)
+		}
+	}
+}
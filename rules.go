@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// rule is a single find/replace pair, along with where it applies.
+type rule struct {
+	matcher matcher
+
+	// filter limits which paths the rule applies to, on top of the
+	// --include and --exclude flags that limit the whole walk.
+	filter pathFilter
+
+	// contents and names say whether the rule applies to file contents,
+	// file names, or both.
+	contents bool
+	names    bool
+
+	// identifiers is set for rules that count hits by identifier style.
+	identifiers bool
+}
+
+// appliesTo reports whether r applies to the contents of f, or to its name
+// if name is set.
+func (r *rule) appliesTo(f *File, isDir bool, name bool) bool {
+	if name && !r.names || !name && !r.contents {
+		return false
+	}
+	return r.filter.allows(f, isDir)
+}
+
+// rulesFor returns the rules that apply to the contents of f, or to its name
+// if name is set, in order. Without --rules, that is the single rule made
+// from FIND and REPLACE. Consecutive literal rules are merged into one, so
+// that they are all matched in a single pass.
+func (fr *findReplace) rulesFor(f *File, name bool) []rule {
+	if len(fr.rules) == 0 {
+		return []rule{{matcher: fr.getMatcher(), contents: true, names: true}}
+	}
+	isDir := false
+	if info, err := f.Info(); err == nil {
+		isDir = info.IsDir()
+	}
+	var rules []rule
+	var group []int
+	for i, r := range fr.rules {
+		if !r.appliesTo(f, isDir, name) {
+			continue
+		}
+		if literalPairs(r.matcher) != nil {
+			group = append(group, i)
+			continue
+		}
+		rules = append(fr.literalGroups.merge(rules, fr.rules, group), r)
+		group = nil
+	}
+	return fr.literalGroups.merge(rules, fr.rules, group)
+}
+
+// literalPairs returns the pairs matched by m if it matches literal strings
+// exactly, or nil otherwise.
+func literalPairs(m matcher) []literalPair {
+	switch m := m.(type) {
+	case literalMatcher:
+		return []literalPair{{find: m.find, replace: m.replace}}
+	case multiLiteralMatcher:
+		return m.pairs
+	}
+	return nil
+}
+
+// literalGroups caches the matchers made by merging runs of consecutive
+// literal rules, since the same runs apply to most files. It is safe for
+// concurrent use.
+type literalGroups struct {
+	mu       sync.Mutex
+	matchers map[string]multiLiteralMatcher
+}
+
+// merge appends the rules at indices group of all to rules, as a single rule
+// matching all of their pairs at once.
+func (g *literalGroups) merge(rules []rule, all []rule, group []int) []rule {
+	switch len(group) {
+	case 0:
+		return rules
+	case 1:
+		return append(rules, all[group[0]])
+	}
+
+	merged := rule{contents: true, names: true}
+	key := make([]string, len(group))
+	for i, index := range group {
+		key[i] = strconv.Itoa(index)
+		merged.identifiers = merged.identifiers || all[index].identifiers
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.matchers[strings.Join(key, ",")]
+	if !ok {
+		var pairs []literalPair
+		for _, index := range group {
+			pairs = append(pairs, literalPairs(all[index].matcher)...)
+		}
+		m = newMultiLiteralMatcher(pairs)
+		if g.matchers == nil {
+			g.matchers = make(map[string]multiLiteralMatcher)
+		}
+		g.matchers[strings.Join(key, ",")] = m
+	}
+	merged.matcher = m
+	return append(rules, merged)
+}
+
+// applyRules applies the rules that apply to f's contents (or its name, if
+// name is set) to s, and returns the result along with every match that was
+// replaced. Every rule is matched against s as it is, never against another
+// rule's replacement: where matches of different rules overlap, the leftmost
+// wins, then the longest, then the one whose rule comes first. visit, if not
+// nil, is called with the matches and s, and returns the matches to go ahead
+// with.
+func (fr *findReplace) applyRules(f *File, s string, name bool, visit func(s string, matches []match) []match) (string, []match) {
+	var matches []match
+	switch rules := fr.rulesFor(f, name); len(rules) {
+	case 0:
+		return s, nil
+	case 1:
+		matches = rules[0].matcher.findAll(s)
+	default:
+		matches = findAllRules(rules, s)
+	}
+	if visit != nil {
+		matches = visit(s, matches)
+	}
+	return replaceMatches(s, matches), matches
+}
+
+// findAllRules returns the matches of rules in s, as applyRules describes.
+// Each rule's next match is only searched for again once the matches taken
+// have gone past its start, so s is scanned about once per rule.
+func findAllRules(rules []rule, s string) []match {
+	next := make([]match, len(rules))
+	state := make([]int, len(rules)) // 0 to search, 1 found, 2 done
+	var matches []match
+	lastEnd := -1
+	for from := 0; from >= 0 && from <= len(s); {
+		best := -1
+		for i, r := range rules {
+			if state[i] == 1 && next[i].start < from {
+				state[i] = 0
+			}
+			if state[i] == 0 {
+				next[i], state[i] = nextRuleMatch(r.matcher.(resumableMatcher), s, from, lastEnd)
+			}
+			if state[i] != 1 {
+				continue
+			}
+			if c := next[i]; best < 0 || c.start < next[best].start || c.start == next[best].start && c.end-c.start > next[best].end-next[best].start {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		found := next[best]
+		matches = append(matches, found)
+		lastEnd, from = found.end, found.end
+		if found.start == found.end {
+			from = afterFirstRune(s, found.end)
+		}
+	}
+	return matches
+}
+
+// nextRuleMatch returns m's first match from from on, skipping an empty match
+// right after the match before it at lastEnd as regexp's FindAll does, and 1
+// if there is one or 2 if there isn't.
+func nextRuleMatch(m resumableMatcher, s string, from int, lastEnd int) (match, int) {
+	found, ok := m.findFrom(s, from)
+	if ok && found.start == found.end && found.start == lastEnd {
+		if from = afterFirstRune(s, found.start); from < 0 {
+			return match{}, 2
+		}
+		found, ok = m.findFrom(s, from)
+	}
+	if !ok {
+		return match{}, 2
+	}
+	return found, 1
+}
+
+// scanRules returns the matches of each rule that applies to f's contents
+// (or its name, if name is set) in s as it is, without replacing any of
+// them. --check and --list report these: unlike applyRules, every match of
+// every rule, even those that overlap a match of another rule.
+func (fr *findReplace) scanRules(f *File, s string, name bool) [][]match {
+	var found [][]match
+	for _, r := range fr.rulesFor(f, name) {
+		found = append(found, r.matcher.findAll(s))
+	}
+	return found
+}
+
+// ruleKeys lists the settings a rule in a rules file may have.
+var ruleKeys = map[string]bool{
+	"find":        true,
+	"replace":     true,
+	"regex":       true,
+	"case":        true,
+	"word":        true,
+	"word_chars":  true,
+	"identifiers": true,
+	"include":     true,
+	"exclude":     true,
+	"apply":       true,
+}
+
+// loadRules reads the rules file at path, in JSON, YAML or TOML according to
+// its extension. Options a rule does not set are taken from defaults.
+func loadRules(path string, defaults matchOptions) ([]rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+
+	var tables []map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		tables, err = parseJSONRules(content)
+	case ".yaml", ".yml":
+		tables, err = parseYAMLRules(content)
+	case ".toml":
+		tables, err = parseTOMLRules(content)
+	default:
+		err = fmt.Errorf("unknown format %q (want .json, .yaml, .yml or .toml)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rules file %v: %w", path, err)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("rules file %v: no rules", path)
+	}
+
+	rules := make([]rule, len(tables))
+	for i, table := range tables {
+		if rules[i], err = compileRule(table, defaults); err != nil {
+			return nil, fmt.Errorf("rules file %v: rule %d: %w", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// parseJSONRules parses a JSON rules file: either an array of rules, or an
+// object whose "rules" key holds one.
+func parseJSONRules(content []byte) ([]map[string]interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	return ruleTables(doc)
+}
+
+// parseYAMLRules parses a YAML rules file: either a sequence of rules, or a
+// mapping whose "rules" key holds one.
+func parseYAMLRules(content []byte) ([]map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	return ruleTables(doc)
+}
+
+// parseTOMLRules parses a TOML rules file, in which the rules are an array
+// of tables named rules, written either as [[rules]] tables or inline.
+func parseTOMLRules(content []byte) ([]map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(content), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc) == 0 {
+		return nil, nil
+	}
+	return ruleTables(doc)
+}
+
+// ruleTables extracts the list of rules from a parsed rules document, which
+// is either the list itself or a mapping with a single "rules" key.
+func ruleTables(doc interface{}) ([]map[string]interface{}, error) {
+	if m, ok := doc.(map[string]interface{}); ok {
+		for key := range m {
+			if key != "rules" {
+				return nil, fmt.Errorf("unknown key %q (want rules)", key)
+			}
+		}
+		doc = m["rules"]
+	}
+	if tables, ok := doc.([]map[string]interface{}); ok {
+		// TOML decodes [[rules]] tables as a list of tables already.
+		return tables, nil
+	}
+	list, ok := doc.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rules must be a list")
+	}
+	tables := make([]map[string]interface{}, len(list))
+	for i, item := range list {
+		if tables[i], ok = item.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("rule %d: must be a mapping of settings", i+1)
+		}
+	}
+	return tables, nil
+}
+
+// compileRule builds a rule from the settings in table.
+func compileRule(table map[string]interface{}, defaults matchOptions) (rule, error) {
+	var keys []string
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !ruleKeys[key] {
+			return rule{}, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+
+	find, err := stringSetting(table, "find", "")
+	if err != nil {
+		return rule{}, err
+	}
+	if find == "" {
+		return rule{}, fmt.Errorf("find must be set and not empty")
+	}
+	if _, ok := table["replace"]; !ok {
+		return rule{}, fmt.Errorf("replace must be set")
+	}
+	replace, err := stringSetting(table, "replace", "")
+	if err != nil {
+		return rule{}, err
+	}
+
+	opts := defaults
+	if opts.regexp, err = boolSetting(table, "regex", opts.regexp); err != nil {
+		return rule{}, err
+	}
+	if opts.word, err = boolSetting(table, "word", opts.word); err != nil {
+		return rule{}, err
+	}
+	if opts.wordChars, err = stringSetting(table, "word_chars", opts.wordChars); err != nil {
+		return rule{}, err
+	}
+	if opts.identifiers, err = boolSetting(table, "identifiers", opts.identifiers); err != nil {
+		return rule{}, err
+	}
+	caseMode, err := stringSetting(table, "case", "")
+	if err != nil {
+		return rule{}, err
+	}
+	switch caseMode {
+	case "":
+	case "sensitive":
+		opts.ignoreCase, opts.preserveCase = false, false
+	case "ignore":
+		opts.ignoreCase, opts.preserveCase = true, false
+	case "preserve":
+		opts.ignoreCase, opts.preserveCase = false, true
+	default:
+		return rule{}, fmt.Errorf("case must be sensitive, ignore or preserve, not %q", caseMode)
+	}
+
+	r := rule{identifiers: opts.identifiers}
+	if r.matcher, err = newMatcher(find, replace, opts); err != nil {
+		return rule{}, err
+	}
+
+	apply, err := stringSetting(table, "apply", "both")
+	if err != nil {
+		return rule{}, err
+	}
+	switch apply {
+	case "both":
+		r.contents, r.names = true, true
+	case "contents":
+		r.contents = true
+	case "names":
+		r.names = true
+	default:
+		return rule{}, fmt.Errorf("apply must be contents, names or both, not %q", apply)
+	}
+
+	for _, setting := range []struct {
+		key  string
+		list *globList
+	}{{"include", &r.filter.include}, {"exclude", &r.filter.exclude}} {
+		globs, err := stringsSetting(table, setting.key)
+		if err != nil {
+			return rule{}, err
+		}
+		for _, glob := range globs {
+			if err := setting.list.Set(glob); err != nil {
+				return rule{}, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// stringSetting returns the string setting key from table, or def if it is
+// not set.
+func stringSetting(table map[string]interface{}, key string, def string) (string, error) {
+	value, ok := table[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%v must be a string", key)
+	}
+	return s, nil
+}
+
+// boolSetting returns the boolean setting key from table, or def if it is
+// not set.
+func boolSetting(table map[string]interface{}, key string, def bool) (bool, error) {
+	value, ok := table[key]
+	if !ok {
+		return def, nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v must be true or false", key)
+	}
+	return b, nil
+}
+
+// stringsSetting returns the setting key from table as a list of strings. A
+// single string is taken as a list of one.
+func stringsSetting(table map[string]interface{}, key string) ([]string, error) {
+	switch value := table[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		list := make([]string, len(value))
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v must be a list of strings", key)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%v must be a string or a list of strings", key)
+}
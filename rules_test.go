@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The same rules, in each format loadRules understands.
+var equivalentRules = map[string]string{
+	"rules.json": `{"rules": [
+		{"find": "alpha", "replace": "beta"},
+		{"find": "beta", "replace": "gamma", "apply": "contents", "include": "*.txt"},
+		{"find": "v(\\d+)", "replace": "version$1", "regex": true, "apply": "names"},
+		{"find": "delta", "replace": "epsilon", "case": "preserve", "exclude": ["skip/"]}
+	]}`,
+	"rules.yaml": `# Renames for the next release.
+rules:
+  - find: alpha
+    replace: beta
+  - find: beta
+    replace: gamma
+    apply: contents
+    include: "*.txt"
+  - find: 'v(\d+)'
+    replace: version$1
+    regex: true
+    apply: names
+  - find: delta
+    replace: epsilon
+    case: preserve
+    exclude:
+      - skip/
+`,
+	"rules.toml": `# Renames for the next release.
+[[rules]]
+find = "alpha"
+replace = "beta"
+
+[[rules]]
+find = "beta"
+replace = "gamma"
+apply = "contents"
+include = "*.txt"
+
+[[rules]]
+find = 'v(\d+)'
+replace = "version$1"
+regex = true
+apply = "names"
+
+[[rules]]
+find = "delta"
+replace = "epsilon"
+case = "preserve"
+exclude = [
+  "skip/", # generated
+]
+`,
+}
+
+func TestRun_RulesInEachFormat(t *testing.T) {
+	for name, rules := range equivalentRules {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, map[string]string{
+				"notes.txt":      "alpha beta Delta",
+				"alpha.md":       "alpha beta DELTA",
+				"v2.txt":         "v2",
+				"skip/delta.txt": "delta",
+			})
+			rulesPath := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			withWorkingDir(t, dir)
+			captureLog(t)
+
+			runOrFatal(t, "--rules", rulesPath)
+			assertTree(t, dir, map[string]string{
+				// No rule rematches another's replacement.
+				"notes.txt": "beta gamma Epsilon",
+				// The second rule only applies to *.txt files.
+				"beta.md": "beta beta EPSILON",
+				// The third rule only applies to names.
+				"version2.txt": "v2",
+				// The fourth rule skips skip/.
+				"skip/delta.txt": "delta",
+			})
+		})
+	}
+}
+
+func TestRun_RulesSwapLiterals(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha-beta.txt": "alpha beta alphabet"})
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"find": "alpha", "replace": "beta"},
+		{"find": "beta", "replace": "alpha"},
+		{"find": "alphabet", "replace": "letters"},
+		{"find": "letters", "replace": "LETTERS", "case": "preserve"}
+	]`
+	if err := os.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	// The rules swap alpha and beta, with the longest match winning; the
+	// last rule never sees the letters the third one replaced alphabet with.
+	runOrFatal(t, "--rules", rulesPath)
+	assertTree(t, dir, map[string]string{"beta-alpha.txt": "beta alpha letters"})
+}
+
+func TestRun_RulesMatchOriginalText(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha.txt": "alpha beta betamax alpha-beta"})
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"find": "alpha", "replace": "beta"},
+		{"find": "beta", "replace": "gamma", "word": true},
+		{"find": "a(x|-)", "replace": "A$1", "regex": true}
+	]`
+	if err := os.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	// The word rule only replaces the beta that was in the file, and the
+	// regex rule loses the overlap with alpha, which starts first.
+	runOrFatal(t, "--rules", rulesPath)
+	assertTree(t, dir, map[string]string{"beta.txt": "beta gamma betamAx beta-gamma"})
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{`[{"find": "a"}]`, "rule 1: replace must be set"},
+		{`[{"find": "", "replace": "b"}]`, "rule 1: find must be set and not empty"},
+		{`[{"find": "a", "replace": "b"}, {"find": "a", "replace": "b", "case": "upper"}]`, "rule 2: case must be sensitive, ignore or preserve"},
+		{`[{"find": "a", "replace": "b", "apply": "everything"}]`, "apply must be contents, names or both"},
+		{`[{"find": "a", "replace": "b", "regexp": true}]`, `unknown setting "regexp"`},
+		{`[{"find": "a", "replace": "b", "regex": "yes"}]`, "regex must be true or false"},
+		{`[{"find": "(", "replace": "b", "regex": true}]`, "invalid regular expression"},
+		{`[{"find": "a", "replace": "b", "include": [1]}]`, "include must be a list of strings"},
+		{`{"rule": []}`, `unknown key "rule"`},
+		{`[]`, "no rules"},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(tc.rules), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if _, err := loadRules(path, matchOptions{}); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("loadRules(%v) = %v; want an error containing %q", tc.rules, err, tc.want)
+		}
+	}
+
+	if _, err := loadRules("rules.ini", matchOptions{}); err == nil {
+		t.Errorf("loadRules of a missing file = nil; want an error")
+	}
+}
+
+func TestLoadRulesUsesFlagDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`[{"find": "alpha", "replace": "beta"}, {"find": "gamma", "replace": "delta", "case": "sensitive"}]`), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	rules, err := loadRules(path, matchOptions{ignoreCase: true})
+	if err != nil {
+		t.Fatalf("loadRules: %v", err)
+	}
+	assertReplaced(t, rules[0].matcher, "ALPHA", "beta")
+	assertReplaced(t, rules[1].matcher, "GAMMA gamma", "GAMMA delta")
+}
+
+// TestLoadRulesSyntax confirms that rules files may use any YAML or TOML
+// syntax for their rules, not only the block style of equivalentRules.
+func TestLoadRulesSyntax(t *testing.T) {
+	for name, rules := range map[string]string{
+		"flow.yaml":       "- {find: foo, replace: bar}\n",
+		"folded.yaml":     "- find: foo\n  replace: >-\n    bar\n",
+		"multiline.toml":  "[[rules]]\nfind = 'foo'\nreplace = \"\"\"bar\"\"\"\n",
+		"inline.toml":     "rules = [{find = \"foo\", replace = \"bar\"}]\n",
+		"documented.toml": "# Nothing but rules.\n[[rules]]\nfind = \"foo\" # old\nreplace = \"bar\" # new\n",
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		loaded, err := loadRules(path, matchOptions{})
+		if err != nil {
+			t.Errorf("loadRules(%v): %v", name, err)
+			continue
+		}
+		if len(loaded) != 1 {
+			t.Errorf("loadRules(%v) = %d rules; want 1", name, len(loaded))
+			continue
+		}
+		assertReplaced(t, loaded[0].matcher, "foo", "bar")
+	}
+}
+
+func TestRun_RulesAndFindAreExclusive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yml")
+	if err := os.WriteFile(path, []byte("- find: alpha\n  replace: beta\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	writeTree(t, dir, map[string]string{"sub/alpha.txt": "alpha"})
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	// With --rules, every argument is a PATH.
+	var stderr bytes.Buffer
+	if got := run([]string{"find-replace", "--rules", path, "sub", "missing"}, nil, io.Discard, &stderr); got != 1 {
+		t.Errorf("run = %d; want 1 for the missing path", got)
+	}
+	assertTree(t, dir, map[string]string{"sub/beta.txt": "beta"})
+}
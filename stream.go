@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamChunkSize is how much of a file streamReplace reads at a time, on
+// top of what it holds back to find matches that cross chunk boundaries. It
+// is a variable so that tests can shrink it.
+var streamChunkSize = 64 * 1024
+
+// boundedMatcher is a matcher that can say how long its matches may be, so
+// that it can be run over a stream a window at a time. maxLen returns the
+// longest match in bytes, or a negative number if there is no limit.
+type boundedMatcher interface {
+	matcher
+	maxLen() int
+}
+
+// streamable reports whether m can be used with streamReplace.
+func streamable(m matcher) bool {
+	if word, ok := m.(wordMatcher); ok {
+		m = word.inner
+	}
+	bounded, ok := m.(boundedMatcher)
+	return ok && bounded.maxLen() >= 0
+}
+
+// streamReplace copies src to dst, replacing every match of m along the way,
+// while holding no more than a fixed window of src in memory. m must be
+// streamable. Matches that cross the boundary between two reads are found by
+// holding back the tail of each window until enough of what follows it has
+// been read to settle every match that could start there. For each window,
+// visit is called with the window, the line number it starts on, and the
+// matches found in it, before any of them are written out. streamReplace
+// reports whether any match changed the text.
+func streamReplace(dst io.Writer, src io.Reader, m matcher, visit func(window string, line int, matches []match)) (bool, error) {
+	var word *wordMatcher
+	if w, ok := m.(wordMatcher); ok {
+		word, m = &w, w.inner
+	}
+
+	// lookahead is how much must follow the start of a match before it
+	// can be settled: the longest possible match, plus the character
+	// after it when word boundaries matter.
+	lookahead := m.(boundedMatcher).maxLen()
+	if word != nil {
+		lookahead += utf8.UTFMax
+	}
+	if lookahead < 1 {
+		lookahead = 1
+	}
+
+	buf := make([]byte, 0, utf8.UTFMax+streamChunkSize+lookahead)
+	// keep is how many bytes at the start of buf have already been
+	// written, and are only there as context for word boundaries.
+	keep := 0
+	line := 1
+	changed, eof := false, false
+	for {
+		for !eof && len(buf) < cap(buf) {
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return changed, err
+			}
+		}
+		window := string(buf)
+
+		// Settle every match that starts early enough for its whole
+		// length to be in the window. flushTo marks how much of the
+		// window is then done with: the end of the last settled match,
+		// and at least up to where an unsettled match could start.
+		var found []match
+		if word != nil {
+			found = word.findAllFrom(window, keep)
+		} else {
+			for _, c := range m.findAll(window[keep:]) {
+				c.start += keep
+				c.end += keep
+				found = append(found, c)
+			}
+		}
+		flushTo := keep
+		var matches []match
+		for _, c := range found {
+			if !eof && c.start+lookahead > len(window) {
+				break
+			}
+			matches = append(matches, c)
+			flushTo = c.end
+		}
+		if eof {
+			flushTo = len(window)
+		} else if safe := len(window) - lookahead + 1; safe > flushTo {
+			flushTo = safe
+		}
+
+		visit(window, line, matches)
+		last := keep
+		for _, c := range matches {
+			if c.replacement != window[c.start:c.end] {
+				changed = true
+			}
+			if _, err := io.WriteString(dst, window[last:c.start]+c.replacement); err != nil {
+				return changed, err
+			}
+			last = c.end
+		}
+		if _, err := io.WriteString(dst, window[last:flushTo]); err != nil {
+			return changed, err
+		}
+		if eof {
+			return changed, nil
+		}
+
+		// Hold on to the last few bytes written as context, and the
+		// unsettled tail of the window for the next scan.
+		keep = flushTo
+		if keep > utf8.UTFMax {
+			keep = utf8.UTFMax
+		}
+		line += strings.Count(window[:flushTo-keep], "\n")
+		buf = buf[:copy(buf, buf[flushTo-keep:])]
+	}
+}
+
+func (m literalMatcher) maxLen() int {
+	return len(m.find)
+}
+
+// maxLen allows for case folding to change the encoded length of each
+// character of find.
+func (m regexpMatcher) maxLen() int {
+	if !m.literal {
+		return -1
+	}
+	return utf8.UTFMax * utf8.RuneCountInString(m.find)
+}
+
+func (m multiLiteralMatcher) maxLen() int {
+	longest := 0
+	for _, pair := range m.pairs {
+		if len(pair.find) > longest {
+			longest = len(pair.find)
+		}
+	}
+	return longest
+}
+
+func (m preserveCaseMatcher) maxLen() int {
+	return utf8.UTFMax * utf8.RuneCountInString(m.find)
+}
+
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
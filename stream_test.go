@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStreamReplaceMatchesInMemory runs each matcher over its input in
+// windows of every small size, and confirms the result is the same as
+// replacing the whole input at once.
+func TestStreamReplaceMatchesInMemory(t *testing.T) {
+	defer func(size int) { streamChunkSize = size }(streamChunkSize)
+
+	tests := []struct {
+		find    string
+		replace string
+		opts    matchOptions
+		input   string
+	}{
+		{"aa", "b", matchOptions{}, "aaaaa xaax aaa"},
+		{"alpha", "beta", matchOptions{}, "alpha\nalphalpha\nno match\nalpha"},
+		{"kelvin", "x", matchOptions{ignoreCase: true}, "KELVIN Kelvin kelvin"},
+		{"foo", "bar", matchOptions{preserveCase: true}, "foo Foo FOO fOo\nfoofoo"},
+		{"user id", "account key", matchOptions{identifiers: true}, "userId user_id USER_ID UserId\nuser-id userid"},
+		{"virt", "vert", matchOptions{word: true}, "virt virtual libvirt (virt) virt"},
+		{"é", "e", matchOptions{word: true}, "é éé aé é"},
+		{"foo foo", "Z", matchOptions{word: true}, "xfoo foo foo foo foo"},
+	}
+	for _, tc := range tests {
+		m := newMatcherOrFatal(t, tc.find, tc.replace, tc.opts)
+		if !streamable(m) {
+			t.Fatalf("matcher for %q with %+v is not streamable", tc.find, tc.opts)
+		}
+		want := replaceMatches(tc.input, m.findAll(tc.input))
+		for size := 1; size <= len(tc.input)+1; size++ {
+			streamChunkSize = size
+			var got bytes.Buffer
+			changed, err := streamReplace(&got, strings.NewReader(tc.input), m, func(string, int, []match) {})
+			if err != nil {
+				t.Fatalf("streamReplace: %v", err)
+			}
+			if got.String() != want || changed != (want != tc.input) {
+				t.Errorf("streaming %q over %q in chunks of %d = %q, %v; want %q, %v", tc.find, tc.input, size, got.String(), changed, want, want != tc.input)
+			}
+		}
+	}
+}
+
+func TestStreamableRejectsRegex(t *testing.T) {
+	if streamable(newMatcherOrFatal(t, "a+", "b", matchOptions{regexp: true})) {
+		t.Errorf("a regular expression matcher is streamable; want it read into memory")
+	}
+}
+
+func TestStreamReplaceReportsLines(t *testing.T) {
+	defer func(size int) { streamChunkSize = size }(streamChunkSize)
+	streamChunkSize = 4
+
+	m := newMatcherOrFatal(t, "foo", "bar", matchOptions{preserveCase: true})
+	input := "foo\n\nfOo\nx\nFOo\n"
+	var got []int
+	_, err := streamReplace(&bytes.Buffer{}, strings.NewReader(input), m, func(window string, line int, matches []match) {
+		for _, c := range matches {
+			if c.ambiguous {
+				got = append(got, line+strings.Count(window[:c.start], "\n"))
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("streamReplace: %v", err)
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 5 {
+		t.Errorf("ambiguous matches reported on lines %v; want [3 5]", got)
+	}
+}
+
+func TestRewriteLeavesUnchangedFileAlone(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	f := newFileOrFatal(t, path)
+	m := literalMatcher{find: "absent", replace: "x"}
+	tempName, err := f.StageRewrite(func(dst io.Writer, src io.Reader) (bool, error) {
+		return streamReplace(dst, src, m, func(string, int, []match) {})
+	})
+	if err != nil {
+		t.Fatalf("StageRewrite: %v", err)
+	}
+	if tempName != "" {
+		t.Errorf("StageRewrite = %q; want no temp file for a file it did not change", tempName)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("StageRewrite replaced a file it did not change")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries after StageRewrite; want the temp file removed", len(entries))
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// claimedPaths remembers the files whose contents have been handled, by
+// their resolved path, so that a file reached both directly and through a
+// symlink is only rewritten once.
+type claimedPaths struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+// claim reports whether path has not been claimed before, claiming it.
+func (c *claimedPaths) claim(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths[path] {
+		return false
+	}
+	if c.paths == nil {
+		c.paths = make(map[string]bool)
+	}
+	c.paths[path] = true
+	return true
+}
+
+// linkList collects the symlinks a walk came across, so that those left
+// dangling can be reported once every rename is done.
+type linkList struct {
+	mu    sync.Mutex
+	links []*File
+}
+
+// add records the symlink f.
+func (l *linkList) add(f *File) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.links = append(l.links, f)
+}
+
+// isSymlink reports whether info describes a symlink.
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&fs.ModeSymlink != 0
+}
+
+// resolveLink returns the resolved path of the symlink f, and what it points
+// to. It returns an error if the link is dangling.
+func resolveLink(f *File) (string, os.FileInfo, error) {
+	real, err := filepath.EvalSymlinks(f.Path)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve symlink %v: %w", f.Path, err)
+	}
+	target, err := os.Stat(real)
+	if err != nil {
+		return "", nil, fmt.Errorf("stat target of symlink %v: %w", f.Path, err)
+	}
+	return real, target, nil
+}
+
+// followsLink reports whether the walk should descend into the symlink f,
+// which points to the directory real. Links are only followed with
+// --follow-symlinks, and only to directories the walk would not otherwise
+// reach: nothing inside a walk root, nothing already reached through another
+// link, and nothing the walk is already inside, which would loop forever (and
+// is reported).
+func (fr *findReplace) followsLink(f *File, real string) bool {
+	if !fr.followSymlinks || fr.insideWalk(f, real) {
+		return false
+	}
+	for dir := f.parent; dir != nil; dir = dir.parent {
+		if within := dir.realPath(); within == real || isWithin(within, real) {
+			fr.reporter().warned(f.Path, fmt.Sprintf("Not following symlink %v: it loops back to %v", f.Path, real))
+			return false
+		}
+	}
+	return fr.claimed.claim(real)
+}
+
+// insideWalk reports whether the resolved path real is inside one of the
+// directories being walked, or the walk root above f.
+func (fr *findReplace) insideWalk(f *File, real string) bool {
+	root := f
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root != f && isWithin(real, root.realPath()) {
+		return true
+	}
+	for _, dir := range fr.rootDirs {
+		if real == dir || isWithin(real, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteLinkTarget replaces the contents of the file that the symlink f
+// points to, in place, leaving the link itself alone. A target inside the
+// walk is left to the walk, which reaches it directly and may rename it, so
+// rewriting it from here too would race with that. Any other target is only
+// rewritten with --follow-symlinks, or for a link named on the command line,
+// and is otherwise skipped.
+func (fr *findReplace) rewriteLinkTarget(f *File, real string, target os.FileInfo) error {
+	if fr.insideWalk(f, real) {
+		return nil
+	}
+	if !target.Mode().IsRegular() || (!fr.followSymlinks && f.parent != nil) {
+		fr.reporter().skipped(f.Path, skipSymlink)
+		return nil
+	}
+	if !fr.claimed.claim(real) {
+		return nil
+	}
+	return fr.ReplaceContents(&File{Path: real, info: target})
+}
+
+// relink points the symlink f at its target with the replacement applied to
+// each element of the target's path, as RenameFile applies it to names, by
+// renaming a new symlink over the old one. As with rewriteLinkTarget, a
+// target outside the walk, which the walk won't have renamed, is only
+// changed with --follow-symlinks, or for a link named on the command line.
+// During a dry run the change is only reported, and under --check or --list
+// the match is reported instead.
+func (fr *findReplace) relink(f *File) error {
+	target, err := os.Readlink(f.Path)
+	if err != nil {
+		return fmt.Errorf("read symlink %v: %w", f.Path, err)
+	}
+	if !fr.followSymlinks && f.parent != nil && !fr.insideWalk(f, targetPath(f, target)) {
+		return nil
+	}
+	newTarget, matches := fr.replaceTarget(f, target)
+	if newTarget == target {
+		return nil
+	}
+	if fr.check != nil {
+		fr.check.report([]string{fr.check.targetLine(f.Path)})
+		fr.styleHits.add(matches)
+		return nil
+	}
+	if fr.prompt != nil && !fr.prompt.approveRelink(f.Path, target, newTarget) {
+		return nil
+	}
+	if fr.dryRun {
+		fr.reporter().relinked(f.Path, target, newTarget, true)
+		fr.styleHits.add(matches)
+		return nil
+	}
+
+	tempName := filepath.Join(f.Dir(), RandomString(20))
+	if err := os.Symlink(newTarget, tempName); err != nil {
+		return fmt.Errorf("create symlink in %v: %w", f.Dir(), err)
+	}
+	if fr.atomic != nil {
+		fr.atomic.stageRelink(f.Path, tempName, target, newTarget)
+		fr.styleHits.add(matches)
+		return nil
+	}
+	if err := f.Commit(tempName); err != nil {
+		return err
+	}
+	fr.reporter().relinked(f.Path, target, newTarget, false)
+	fr.styleHits.add(matches)
+	if fr.journal != nil {
+		if err := fr.journal.relinked(f.Path, target, newTarget); err != nil {
+			return err
+		}
+	}
+	if fr.fsync {
+		return fsyncDir(f.Dir())
+	}
+	return nil
+}
+
+// targetPath returns the path that target, the target of the symlink f,
+// names, relative to the resolved directory f is in. Only f's directory is
+// resolved, since the target may not exist, or may have been renamed already.
+func targetPath(f *File, target string) string {
+	if filepath.IsAbs(target) || f.parent == nil {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(f.parent.realPath(), target)
+}
+
+// replaceTarget applies the rules for f's name to each element of target, a
+// symlink's target, leaving separators, "." and ".." alone. It returns the
+// new target and every match that was replaced.
+func (fr *findReplace) replaceTarget(f *File, target string) (string, []match) {
+	elems := strings.Split(target, string(filepath.Separator))
+	var all []match
+	for i, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+		var matches []match
+		elems[i], matches = fr.applyRules(f, elem, true, func(name string, matches []match) []match {
+			fr.reportAmbiguousName(f.Path, name, matches)
+			return matches
+		})
+		all = append(all, matches...)
+	}
+	return strings.Join(elems, string(filepath.Separator)), all
+}
+
+// reportDangling warns about every symlink the walk came across that, now
+// that every rename is done, points at nothing.
+func (fr *findReplace) reportDangling() {
+	for _, f := range fr.links.links {
+		path := f.currentPath()
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			fr.fail(fmt.Errorf("read symlink %v: %w", path, err))
+			continue
+		}
+		fr.reporter().warned(path, fmt.Sprintf("Symlink %v is dangling: %v does not exist", path, target))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// symlinkOrFatal creates a symlink at link pointing to target.
+func symlinkOrFatal(t *testing.T, target string, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Symlink(%q, %q): %v", target, link, err)
+	}
+}
+
+// assertSymlink fails the test unless path is a symlink pointing to target.
+func assertSymlink(t *testing.T, path string, target string) {
+	t.Helper()
+	got, err := os.Readlink(path)
+	if err != nil {
+		t.Errorf("Readlink(%q): %v", path, err)
+	} else if got != target {
+		t.Errorf("Readlink(%q) = %q; want %q", path, got, target)
+	}
+}
+
+func TestClaimedPaths(t *testing.T) {
+	var c claimedPaths
+	if !c.claim("a") || c.claim("a") || !c.claim("b") {
+		t.Errorf("claim should only succeed the first time for each path")
+	}
+}
+
+// TestRun_SymlinkToFileInsideRoot confirms that a symlink to a file in the
+// walk is left a symlink, and that its target is rewritten exactly once,
+// using a replacement that would compound if applied twice.
+func TestRun_SymlinkToFileInsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"target.txt": "z"})
+	symlinkOrFatal(t, "target.txt", filepath.Join(dir, "link.txt"))
+	symlinkOrFatal(t, "link.txt", filepath.Join(dir, "z.txt"))
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "z", "zz")
+	assertTree(t, dir, map[string]string{"target.txt": "zz"})
+	assertSymlink(t, filepath.Join(dir, "link.txt"), "target.txt")
+	assertSymlink(t, filepath.Join(dir, "zz.txt"), "link.txt")
+}
+
+// TestRun_SymlinkBesideItsTarget confirms that a file and a symlink to it in
+// the same directory, handled concurrently, leave the file rewritten under its
+// new name, rather than the link rewriting it at its old path while it's
+// renamed.
+func TestRun_SymlinkBesideItsTarget(t *testing.T) {
+	dir := t.TempDir()
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		sub := fmt.Sprintf("dir%d", i)
+		writeTree(t, dir, map[string]string{sub + "/alpha.txt": "alpha"})
+		symlinkOrFatal(t, "alpha.txt", filepath.Join(dir, sub, "link"))
+		want[sub+"/beta.txt"] = "beta"
+	}
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "-j", "8", "alpha", "beta")
+	assertTree(t, dir, want)
+	for name := range want {
+		stale := filepath.Join(dir, filepath.Dir(name), "alpha.txt")
+		if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+			t.Errorf("Lstat(%q) = %v; want it not to exist", stale, err)
+		}
+	}
+}
+
+// TestRun_AtomicSymlinkToFileInsideRoot confirms that a symlink to a file
+// elsewhere in the walk doesn't stage a rewrite of it in a directory the walk
+// has yet to list.
+func TestRun_AtomicSymlinkToFileInsideRoot(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a/.keep": "", "b/alpha.txt": "alpha"})
+	symlinkOrFatal(t, "../b/alpha.txt", filepath.Join(dir, "a", "link"))
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--atomic", "-j", "1", "alpha", "alphas")
+	assertTree(t, dir, map[string]string{"a/.keep": "", "b/alphas.txt": "alphas"})
+	assertSymlink(t, filepath.Join(dir, "a", "link"), "../b/alpha.txt")
+}
+
+func TestRun_SymlinkNamedOnCommandLine(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{"target.txt": "alpha", "sub/file.txt": "alpha"})
+	symlinkOrFatal(t, filepath.Join(outside, "target.txt"), filepath.Join(dir, "link.txt"))
+	symlinkOrFatal(t, filepath.Join(outside, "sub"), filepath.Join(dir, "dir"))
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "alpha", "beta", "link.txt", "dir")
+	assertTree(t, outside, map[string]string{"target.txt": "beta", "sub/file.txt": "beta"})
+	assertSymlink(t, filepath.Join(dir, "link.txt"), filepath.Join(outside, "target.txt"))
+	assertSymlink(t, filepath.Join(dir, "dir"), filepath.Join(outside, "sub"))
+}
+
+func TestRun_SymlinksOutsideRoot(t *testing.T) {
+	for _, follow := range []bool{false, true} {
+		dir := t.TempDir()
+		outside := t.TempDir()
+		outsideFiles := map[string]string{"target.txt": "alpha", "sub/file.txt": "alpha"}
+		writeTree(t, outside, outsideFiles)
+		symlinkOrFatal(t, filepath.Join(outside, "target.txt"), filepath.Join(dir, "alpha.txt"))
+		symlinkOrFatal(t, filepath.Join(outside, "sub"), filepath.Join(dir, "dir"))
+		symlinkOrFatal(t, "missing", filepath.Join(dir, "dangling-alpha"))
+		withWorkingDir(t, dir)
+		captureLog(t)
+
+		args := []string{"alpha", "beta"}
+		if follow {
+			args = append([]string{"--follow-symlinks"}, args...)
+			outsideFiles = map[string]string{"target.txt": "beta", "sub/file.txt": "beta"}
+		}
+		runOrFatal(t, args...)
+		assertTree(t, outside, outsideFiles)
+
+		// Links are renamed like anything else, but stay links.
+		assertSymlink(t, filepath.Join(dir, "beta.txt"), filepath.Join(outside, "target.txt"))
+		assertSymlink(t, filepath.Join(dir, "dir"), filepath.Join(outside, "sub"))
+		assertSymlink(t, filepath.Join(dir, "dangling-beta"), "missing")
+	}
+}
+
+// TestRun_FollowSymlinksWalksEachDirectoryOnce confirms that
+// --follow-symlinks doesn't walk a directory that is already walked, or
+// already reached through another link, a second time, which would try to
+// rename everything in it twice.
+func TestRun_FollowSymlinksWalksEachDirectoryOnce(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeTree(t, dir, map[string]string{"sub/alpha.txt": "z"})
+	writeTree(t, outside, map[string]string{"alpha.txt": "z"})
+	symlinkOrFatal(t, "sub", filepath.Join(dir, "inside"))
+	symlinkOrFatal(t, outside, filepath.Join(dir, "first"))
+	symlinkOrFatal(t, outside, filepath.Join(dir, "second"))
+	withWorkingDir(t, dir)
+	captureLog(t)
+
+	runOrFatal(t, "--follow-symlinks", "alpha", "beta")
+	runOrFatal(t, "--follow-symlinks", "z", "zz")
+	assertTree(t, dir, map[string]string{"sub/beta.txt": "zz"})
+	assertTree(t, outside, map[string]string{"beta.txt": "zz"})
+}
+
+func TestRun_FollowSymlinksDetectsCycles(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{"loop/file.txt": "alpha"})
+	symlinkOrFatal(t, "..", filepath.Join(outside, "loop", "up"))
+	symlinkOrFatal(t, ".", filepath.Join(outside, "loop", "self"))
+	symlinkOrFatal(t, filepath.Join(outside, "loop"), filepath.Join(dir, "ext"))
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	runOrFatal(t, "--follow-symlinks", "alpha", "beta")
+	assertTree(t, outside, map[string]string{"loop/file.txt": "beta"})
+	for _, link := range []string{"ext/up", "ext/self"} {
+		if want := "Not following symlink " + filepath.Join(dir, link); !strings.Contains(logs.String(), want) {
+			t.Errorf("log output = %q; want it to contain %q", logs.String(), want)
+		}
+	}
+}
+
+func TestReplaceTarget(t *testing.T) {
+	fr := findReplace{find: "alpha", replace: "beta"}
+	f := &File{Path: "/tmp/link"}
+	for target, want := range map[string]string{
+		"../alpha/config":  "../beta/config",
+		"/srv/alphabet/./": "/srv/betabet/./",
+		"alpha":            "beta",
+		"../other":         "../other",
+	} {
+		if got, _ := fr.replaceTarget(f, target); got != want {
+			t.Errorf("replaceTarget(%q) = %q; want %q", target, got, want)
+		}
+	}
+}
+
+func TestRun_Relink(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		t.Setenv("XDG_STATE_HOME", t.TempDir())
+		dir := t.TempDir()
+		writeTree(t, dir, map[string]string{"alpha/config": "x", "links/.keep": ""})
+		symlinkOrFatal(t, "../alpha/config", filepath.Join(dir, "links", "config"))
+		symlinkOrFatal(t, "../missing/alpha", filepath.Join(dir, "links", "alpha-dangling"))
+		withWorkingDir(t, dir)
+		logs := captureLog(t)
+
+		args := []string{"--relink", "alpha", "beta"}
+		if atomic {
+			args = append([]string{"--atomic"}, args...)
+		}
+		runOrFatal(t, args...)
+		assertSymlink(t, filepath.Join(dir, "links", "config"), "../beta/config")
+		assertTree(t, dir, map[string]string{"links/config": "x"})
+		dangling := filepath.Join(dir, "links", "beta-dangling")
+		assertSymlink(t, dangling, "../missing/beta")
+		if want := "Symlink " + dangling + " is dangling"; !strings.Contains(logs.String(), want) {
+			t.Errorf("log output = %q; want it to contain %q", logs.String(), want)
+		}
+		if strings.Contains(logs.String(), "links/config is dangling") {
+			t.Errorf("log output = %q; want only the dangling symlink reported", logs.String())
+		}
+
+		runOrFatal(t, "undo")
+		assertSymlink(t, filepath.Join(dir, "links", "config"), "../alpha/config")
+		assertSymlink(t, filepath.Join(dir, "links", "alpha-dangling"), "../missing/alpha")
+		assertTree(t, dir, map[string]string{"links/config": "x"})
+	}
+}
+
+func TestRun_RelinkDryRunAndCheck(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"alpha.txt": "x"})
+	symlinkOrFatal(t, "alpha.txt", filepath.Join(dir, "link"))
+	withWorkingDir(t, dir)
+	logs := captureLog(t)
+
+	runOrFatal(t, "--relink", "--dry-run", "alpha", "beta")
+	assertSymlink(t, filepath.Join(dir, "link"), "alpha.txt")
+	if want := "Would point symlink " + filepath.Join(dir, "link") + " to beta.txt"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log output = %q; want it to contain %q", logs.String(), want)
+	}
+
+	code, lines := runCheck(t, "--relink", "alpha", "beta")
+	want := []string{
+		filepath.Join(dir, "alpha.txt") + ": name matches",
+		filepath.Join(dir, "link") + ": symlink target matches",
+	}
+	if code != exitFound || !reflect.DeepEqual(lines, want) {
+		t.Errorf("run --check --relink = %d, %q; want %d, %q", code, lines, exitFound, want)
+	}
+	assertSymlink(t, filepath.Join(dir, "link"), "alpha.txt")
+}
+
+// TestRun_RelinkOutsideWalk confirms that a symlink pointing outside the walk
+// keeps its target, which the walk did not rename, unless --follow-symlinks
+// is given, while an absolute target inside the walk is still followed.
+func TestRun_RelinkOutsideWalk(t *testing.T) {
+	for _, follow := range []bool{false, true} {
+		dir := t.TempDir()
+		outside := t.TempDir()
+		writeTree(t, dir, map[string]string{"alpha/config": "x", "links/.keep": ""})
+		writeTree(t, outside, map[string]string{"alpha/config": "y"})
+		symlinkOrFatal(t, filepath.Join(dir, "alpha", "config"), filepath.Join(dir, "links", "inside"))
+		symlinkOrFatal(t, filepath.Join(outside, "alpha", "config"), filepath.Join(dir, "links", "outside"))
+		withWorkingDir(t, dir)
+		captureLog(t)
+
+		args := []string{"--relink", "--no-journal", "alpha", "beta"}
+		if follow {
+			args = append([]string{"--follow-symlinks"}, args...)
+		}
+		runOrFatal(t, args...)
+		assertSymlink(t, filepath.Join(dir, "links", "inside"), filepath.Join(dir, "beta", "config"))
+		want := filepath.Join(outside, "alpha", "config")
+		if follow {
+			want = filepath.Join(outside, "beta", "config")
+		}
+		assertSymlink(t, filepath.Join(dir, "links", "outside"), want)
+	}
+}